@@ -0,0 +1,379 @@
+package spotifaux
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// IsArchive reports whether name is a zip or tar(.gz) sample pack that a Corpus can descend into
+func IsArchive(name string) bool {
+	name = strings.ToLower(name)
+	for _, ext := range []string{".zip", ".tar", ".tar.gz", ".tgz"} {
+		if strings.HasSuffix(name, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// archiveFS serves the contents of archives found in fsys as directories, so that
+// "packs/drums.zip/kick/01.wav" opens 01.wav from inside drums.zip without extracting it
+type archiveFS struct {
+	fsys   fs.FS
+	mu     sync.Mutex
+	opened map[string]fs.FS
+}
+
+func newArchiveFS(fsys fs.FS) *archiveFS {
+	return &archiveFS{fsys: fsys, opened: map[string]fs.FS{}}
+}
+
+func (a *archiveFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+
+	elems := strings.Split(name, "/")
+	for i, elem := range elems {
+		if !IsArchive(elem) {
+			continue
+		}
+		prefix := strings.Join(elems[:i+1], "/")
+		sub, err := a.archive(prefix)
+		if err != nil {
+			return nil, err
+		}
+		if sub == nil {
+			continue // a directory that happens to be named like an archive
+		}
+		rest := strings.Join(elems[i+1:], "/")
+		if rest == "" {
+			rest = "."
+		}
+		return sub.Open(rest)
+	}
+	return a.fsys.Open(name)
+}
+
+// archive returns the (cached) file system of the archive at name, or nil if name is a directory
+func (a *archiveFS) archive(name string) (fs.FS, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if sub, ok := a.opened[name]; ok {
+		return sub, nil
+	}
+
+	f, err := a.fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if fi.IsDir() {
+		f.Close()
+		a.opened[name] = nil
+		return nil, nil
+	}
+
+	var sub fs.FS
+	if strings.HasSuffix(strings.ToLower(name), ".zip") {
+		sub, err = openZip(f, fi.Size())
+	} else {
+		f.Close()
+		sub, err = indexTar(func() (io.ReadCloser, error) {
+			return openTar(a.fsys, name)
+		})
+	}
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+
+	// nested archives are served the same way
+	sub = newArchiveFS(sub)
+	a.opened[name] = sub
+	return sub, nil
+}
+
+// openZip reads members straight from f when it supports random access (files on disk), which keeps
+// f open for the life of the corpus. Otherwise, as for a zip inside a tar, it copies the archive to a
+// temporary file first.
+func openZip(f fs.File, size int64) (fs.FS, error) {
+	if ra, ok := f.(io.ReaderAt); ok {
+		zr, err := zip.NewReader(ra, size)
+		if err != nil {
+			f.Close()
+		}
+		return zr, err
+	}
+
+	defer f.Close()
+	tmp, err := os.CreateTemp("", "spotifaux-*.zip")
+	if err != nil {
+		return nil, err
+	}
+	// the open file stays readable once removed, except on Windows, where it is left behind
+	defer os.Remove(tmp.Name())
+	size, err = io.Copy(tmp, f)
+	if err != nil {
+		tmp.Close()
+		return nil, err
+	}
+	zr, err := zip.NewReader(tmp, size)
+	if err != nil {
+		tmp.Close()
+	}
+	return zr, err
+}
+
+// openTar reads the tar archive at name in fsys from its start, decompressing a .gz or .tgz
+func openTar(fsys fs.FS, name string) (io.ReadCloser, error) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	lower := strings.ToLower(name)
+	if !strings.HasSuffix(lower, ".gz") && !strings.HasSuffix(lower, ".tgz") {
+		return f, nil
+	}
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return gzipFile{Reader: zr, f: f}, nil
+}
+
+type gzipFile struct {
+	*gzip.Reader
+	f fs.File
+}
+
+func (g gzipFile) Close() error {
+	g.Reader.Close()
+	return g.f.Close()
+}
+
+// tarFS serves a tar archive from an index of its headers. Since tar has nothing to seek by, a member
+// is read whole into memory when opened, from a reader left where the last member opened ended, so
+// that opening members in archive order reads the archive once. Members opened again, as when
+// rendering reads a unit at a time, are kept up to tarCacheBytes, beyond which the members opened
+// least recently are dropped.
+type tarFS struct {
+	open    func() (io.ReadCloser, error)
+	entries map[string]*tarEntry
+
+	mu     sync.Mutex
+	r      io.ReadCloser // nil until a member is opened
+	tr     *tar.Reader
+	next   int // the header tr reads next
+	cached map[int][]byte
+	order  []int // of the cached members, opened least recently first
+	bytes  int64
+}
+
+const tarCacheBytes = 64 << 20
+
+// tarEntry is a member of a tar archive, or a directory implied by the path of one
+type tarEntry struct {
+	name    string
+	header  int // of the member in the archive, counting from 0, -1 for an implied directory
+	size    int64
+	dir     bool
+	modTime time.Time
+}
+
+// indexTar reads the headers of the tar archive read by open
+func indexTar(open func() (io.ReadCloser, error)) (*tarFS, error) {
+	r, err := open()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	t := &tarFS{open: open, entries: map[string]*tarEntry{}, cached: map[int][]byte{}}
+	tr := tar.NewReader(r)
+	for header := 0; ; header++ {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return t, nil
+		} else if err != nil {
+			return nil, err
+		}
+
+		name := path.Clean(strings.TrimPrefix(h.Name, "/"))
+		if !fs.ValidPath(name) || name == "." {
+			continue
+		}
+		switch h.Typeflag {
+		case tar.TypeReg:
+			t.add(name, &tarEntry{name: path.Base(name), header: header, size: h.Size, modTime: h.ModTime})
+		case tar.TypeDir:
+			t.add(name, &tarEntry{name: path.Base(name), header: header, dir: true, modTime: h.ModTime})
+		}
+	}
+}
+
+func (t *tarFS) add(name string, e *tarEntry) {
+	t.entries[name] = e
+	for dir := path.Dir(name); dir != "."; dir = path.Dir(dir) {
+		if _, ok := t.entries[dir]; ok {
+			break
+		}
+		t.entries[dir] = &tarEntry{name: path.Base(dir), header: -1, dir: true}
+	}
+}
+
+func (t *tarFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+
+	e, ok := t.entries[name]
+	if name == "." {
+		e, ok = &tarEntry{name: ".", header: -1, dir: true}, true
+	}
+	if !ok {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+
+	if e.dir {
+		var entries []fs.DirEntry
+		for p, child := range t.entries {
+			if path.Dir(p) == name {
+				entries = append(entries, fs.FileInfoToDirEntry(child))
+			}
+		}
+		sort.Slice(entries, func(i, j int) bool {
+			return entries[i].Name() < entries[j].Name()
+		})
+		return &tarDir{tarEntry: e, entries: entries}, nil
+	}
+
+	b, err := t.member(e.header)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	return &tarFile{tarEntry: e, Reader: bytes.NewReader(b)}, nil
+}
+
+// member returns the contents of the member at header, from the cache or else read on from the last
+// member read, going back to the start of the archive only for a member before it
+func (t *tarFS) member(header int) ([]byte, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if b, ok := t.cached[header]; ok {
+		for i, h := range t.order {
+			if h == header {
+				t.order = append(append(t.order[:i:i], t.order[i+1:]...), header)
+				break
+			}
+		}
+		return b, nil
+	}
+
+	if t.r == nil || header < t.next {
+		if t.r != nil {
+			t.r.Close()
+		}
+		r, err := t.open()
+		if err != nil {
+			t.r = nil
+			return nil, err
+		}
+		t.r, t.tr, t.next = r, tar.NewReader(r), 0
+	}
+	for ; t.next <= header; t.next++ {
+		if _, err := t.tr.Next(); err != nil {
+			t.r.Close()
+			t.r = nil
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF // the archive changed since it was indexed
+			}
+			return nil, err
+		}
+	}
+	b, err := io.ReadAll(t.tr)
+	if err != nil {
+		t.r.Close()
+		t.r = nil
+		return nil, err
+	}
+
+	size := int64(len(b))
+	if size <= tarCacheBytes {
+		for len(t.order) > 0 && t.bytes+size > tarCacheBytes {
+			t.bytes -= int64(len(t.cached[t.order[0]]))
+			delete(t.cached, t.order[0])
+			t.order = t.order[1:]
+		}
+		t.cached[header] = b
+		t.order = append(t.order, header)
+		t.bytes += size
+	}
+	return b, nil
+}
+
+func (e *tarEntry) Name() string { return e.name }
+func (e *tarEntry) Size() int64  { return e.size }
+func (e *tarEntry) Mode() fs.FileMode {
+	if e.dir {
+		return fs.ModeDir | 0555
+	}
+	return 0444
+}
+func (e *tarEntry) ModTime() time.Time         { return e.modTime }
+func (e *tarEntry) IsDir() bool                { return e.dir }
+func (e *tarEntry) Sys() interface{}           { return nil }
+func (e *tarEntry) Stat() (fs.FileInfo, error) { return e, nil }
+
+// tarFile reads a member of the archive from memory, and so can seek
+type tarFile struct {
+	*tarEntry
+	*bytes.Reader
+}
+
+func (f *tarFile) Close() error { return nil }
+
+type tarDir struct {
+	*tarEntry
+	entries []fs.DirEntry
+}
+
+func (d *tarDir) Close() error { return nil }
+
+func (d *tarDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.name, Err: fs.ErrInvalid}
+}
+
+func (d *tarDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	if n <= 0 {
+		entries := d.entries
+		d.entries = nil
+		return entries, nil
+	}
+	if len(d.entries) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(d.entries) {
+		n = len(d.entries)
+	}
+	entries := d.entries[:n]
+	d.entries = d.entries[n:]
+	return entries, nil
+}
@@ -0,0 +1,244 @@
+package spotifaux
+
+import (
+	"bytes"
+	"github.com/faiface/beep"
+	"github.com/faiface/beep/effects"
+	"io"
+	"io/fs"
+)
+
+const resampleQuality = 6
+
+// AudioStream decodes any registered format, downmixed to mono and resampled to SAMPLE_RATE
+type AudioStream struct {
+	src    beep.StreamSeekCloser
+	format beep.Format
+	out    beep.Streamer
+	buf    [][2]float64
+	Frames int // approximate length in frames at SAMPLE_RATE
+}
+
+// OpenAudio opens fileName in fsys, e.g. a Corpus or os.DirFS
+func OpenAudio(fsys fs.FS, fileName string) (*AudioStream, error) {
+	decode, err := decoderFor(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := openSeekable(fsys, fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	src, format, err := decode(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	a := &AudioStream{
+		src:    src,
+		format: format,
+		buf:    make([][2]float64, 4096),
+		Frames: int(int64(src.Len()) * SAMPLE_RATE / int64(format.SampleRate)),
+	}
+	a.reset()
+
+	return a, nil
+}
+
+// Decoders seek on their reader, so archive members that cannot seek are buffered in memory
+func openSeekable(fsys fs.FS, fileName string) (io.ReadCloser, error) {
+	f, err := fsys.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := f.(io.Seeker); ok {
+		return f, nil
+	}
+
+	defer f.Close()
+	b, err := io.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+	return bufferedFile{bytes.NewReader(b)}, nil
+}
+
+type bufferedFile struct {
+	*bytes.Reader
+}
+
+func (bufferedFile) Close() error {
+	return nil
+}
+
+// rebuild the mono/resample chain, which buffers ahead of the source position
+func (a *AudioStream) reset() {
+	a.out = effects.Mono(a.src)
+	if a.format.SampleRate != SAMPLE_RATE {
+		a.out = beep.Resample(resampleQuality, a.format.SampleRate, SAMPLE_RATE, a.out)
+	}
+}
+
+// Seek positions the stream at frame (in SAMPLE_RATE frames)
+func (a *AudioStream) Seek(frame int) error {
+	p := int(int64(frame) * int64(a.format.SampleRate) / SAMPLE_RATE)
+	if err := a.src.Seek(p); err != nil {
+		// Some decoders (flac) cannot seek, so decode forward and discard instead
+		if p < a.src.Position() {
+			return err
+		}
+		for skip := p - a.src.Position(); skip > 0; {
+			chunk := skip
+			if chunk > len(a.buf) {
+				chunk = len(a.buf)
+			}
+			n, ok := a.src.Stream(a.buf[:chunk])
+			skip -= n
+			if !ok {
+				break
+			}
+		}
+		// a target at or past the end is a short read, which ReadFrames reports
+		if err := a.src.Err(); err != nil && err != io.EOF {
+			return err
+		}
+	}
+	a.reset()
+	return nil
+}
+
+// canSeek reports whether the decoder seeks, rather than Seek decoding forward to the frame. It is
+// called before anything is read.
+func (a *AudioStream) canSeek() bool {
+	return a.src.Seek(0) == nil
+}
+
+// ReadFrames fills buf with mono samples and returns the number of frames read
+func (a *AudioStream) ReadFrames(buf []float64) (int, error) {
+	read := 0
+	for read < len(buf) {
+		chunk := len(buf) - read
+		if chunk > len(a.buf) {
+			chunk = len(a.buf)
+		}
+		n, ok := a.out.Stream(a.buf[:chunk])
+		for i := 0; i < n; i++ {
+			buf[read+i] = a.buf[i][0]
+		}
+		read += n
+		if !ok {
+			break
+		}
+	}
+	if err := a.out.Err(); err != nil {
+		return read, err
+	}
+	if read == 0 && len(buf) > 0 {
+		return 0, io.EOF
+	}
+	return read, nil
+}
+
+// ReadAll decodes the rest of the stream
+func (a *AudioStream) ReadAll() ([]float64, error) {
+	samples := make([]float64, 0, a.Frames)
+	buf := make([]float64, len(a.buf))
+	for {
+		n, err := a.ReadFrames(buf)
+		samples = append(samples, buf[:n]...)
+		if err == io.EOF {
+			return samples, nil
+		} else if err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (a *AudioStream) Close() error {
+	return a.src.Close()
+}
+
+// AudioReader reads stretches of the audio files of a file system. A file whose decoder cannot seek is
+// decoded once and kept, rather than decoded from its start again for every stretch read from it, up
+// to MaxBytes of decoded audio, beyond which the files read least recently are dropped.
+type AudioReader struct {
+	MaxBytes int64 // DefaultAudioReaderBytes from NewAudioReader
+	fsys     fs.FS
+	decoded  map[string][]float64
+	order    []string // of the decoded files, read least recently first
+	bytes    int64
+}
+
+// DefaultAudioReaderBytes is about 9 minutes of decoded audio at SAMPLE_RATE
+const DefaultAudioReaderBytes = 64 << 20
+
+func NewAudioReader(fsys fs.FS) *AudioReader {
+	return &AudioReader{MaxBytes: DefaultAudioReaderBytes, fsys: fsys, decoded: map[string][]float64{}}
+}
+
+// Read fills buf with the samples of fileName from frame on and returns how many there were, fewer
+// than len(buf) near the end of the file
+func (r *AudioReader) Read(fileName string, frame int, buf []float64) (int, error) {
+	samples, ok := r.decoded[fileName]
+	if ok {
+		r.touch(fileName)
+	} else {
+		a, err := OpenAudio(r.fsys, fileName)
+		if err != nil {
+			return 0, err
+		}
+		defer a.Close()
+
+		if a.canSeek() {
+			err = a.Seek(frame)
+			if err != nil {
+				return 0, err
+			}
+			n, err := a.ReadFrames(buf)
+			if err == io.EOF {
+				err = nil
+			}
+			return n, err
+		}
+
+		samples, err = a.ReadAll()
+		if err != nil {
+			return 0, err
+		}
+		r.keep(fileName, samples)
+	}
+	if frame >= len(samples) {
+		return 0, nil
+	}
+	return copy(buf, samples[frame:]), nil
+}
+
+// touch marks fileName as read most recently
+func (r *AudioReader) touch(fileName string) {
+	for i, name := range r.order {
+		if name == fileName {
+			r.order = append(append(r.order[:i:i], r.order[i+1:]...), fileName)
+			return
+		}
+	}
+}
+
+// keep adds the samples of fileName, dropping the files read least recently to stay within MaxBytes.
+// A file larger than MaxBytes on its own is not kept.
+func (r *AudioReader) keep(fileName string, samples []float64) {
+	size := int64(8 * len(samples))
+	if size > r.MaxBytes {
+		return
+	}
+	for len(r.order) > 0 && r.bytes+size > r.MaxBytes {
+		r.bytes -= int64(8 * len(r.decoded[r.order[0]]))
+		delete(r.decoded, r.order[0])
+		r.order = r.order[1:]
+	}
+	r.decoded[fileName] = samples
+	r.order = append(r.order, fileName)
+	r.bytes += size
+}
@@ -0,0 +1,171 @@
+package spotifaux_test
+
+import (
+	"errors"
+	"github.com/faiface/beep"
+	"github.com/faiface/beep/wav"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"spotifaux"
+	"testing"
+)
+
+// writeTestWav writes mono 16 bit samples at sampleRate
+func writeTestWav(t testing.TB, fileName string, samples []float64, sampleRate int) {
+	f, err := os.Create(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	i := 0
+	s := beep.StreamerFunc(func(buf [][2]float64) (int, bool) {
+		n := 0
+		for ; n < len(buf) && i < len(samples); n, i = n+1, i+1 {
+			buf[n] = [2]float64{samples[i], samples[i]}
+		}
+		return n, n > 0
+	})
+	err = wav.Encode(f, s, beep.Format{SampleRate: beep.SampleRate(sampleRate), NumChannels: 1, Precision: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// noSeek is a decoder that cannot seek and reports io.EOF at the end of the stream, as flac does
+type noSeek struct {
+	beep.StreamSeekCloser
+	done bool
+}
+
+func (d *noSeek) Stream(samples [][2]float64) (int, bool) {
+	n, ok := d.StreamSeekCloser.Stream(samples)
+	if n < len(samples) {
+		d.done = true
+	}
+	return n, ok
+}
+
+func (d *noSeek) Err() error {
+	if d.done {
+		return io.EOF
+	}
+	return d.StreamSeekCloser.Err()
+}
+
+func (*noSeek) Seek(int) error {
+	return errors.New("cannot seek")
+}
+
+func init() {
+	spotifaux.RegisterDecoder(".NoSeek", func(rc io.ReadCloser) (beep.StreamSeekCloser, beep.Format, error) {
+		s, format, err := wav.Decode(rc)
+		return &noSeek{StreamSeekCloser: s}, format, err
+	})
+}
+
+func Test_openAudioResamples(t *testing.T) {
+	dir := t.TempDir()
+	tone := make([]float64, 4000)
+	for i := range tone {
+		tone[i] = 0.5 * math.Sin(2*math.Pi*440*float64(i)/8000)
+	}
+	writeTestWav(t, filepath.Join(dir, "tone.wav"), tone, 8000)
+
+	assert.True(t, spotifaux.IsAudioFile("tone.WAV"))
+	assert.True(t, spotifaux.IsAudioFile("tone.noseek"))
+	assert.False(t, spotifaux.IsAudioFile("tone.txt"))
+
+	a, err := spotifaux.OpenAudio(os.DirFS(dir), "tone.wav")
+	assert.NoError(t, err)
+	defer a.Close()
+	assert.Equal(t, 8000, a.Frames)
+
+	samples, err := a.ReadAll()
+	assert.NoError(t, err)
+	assert.InDelta(t, 8000, len(samples), 16)
+	for i := 1000; i < 7000; i++ {
+		assert.InDelta(t, 0.5*math.Sin(2*math.Pi*440*float64(i)/spotifaux.SAMPLE_RATE), samples[i], 0.02)
+	}
+}
+
+func Test_seekNearEndOfUnseekableAudio(t *testing.T) {
+	dir := t.TempDir()
+	ramp := make([]float64, 1000)
+	for i := range ramp {
+		ramp[i] = float64(i) / 2000
+	}
+	writeTestWav(t, filepath.Join(dir, "ramp.wav"), ramp, spotifaux.SAMPLE_RATE)
+	assert.NoError(t, os.Link(filepath.Join(dir, "ramp.wav"), filepath.Join(dir, "ramp.noseek")))
+
+	a, err := spotifaux.OpenAudio(os.DirFS(dir), "ramp.noseek")
+	assert.NoError(t, err)
+	defer a.Close()
+	assert.NoError(t, a.Seek(990))
+	buf := make([]float64, 20)
+	n, err := a.ReadFrames(buf)
+	assert.True(t, err == nil || err == io.EOF)
+	assert.Equal(t, 10, n)
+	assert.InDeltaSlice(t, ramp[990:], buf[:n], 1e-3)
+
+	assert.NoError(t, a.Seek(1000))
+	n, err = a.ReadFrames(buf)
+	assert.Equal(t, 0, n)
+	assert.Equal(t, io.EOF, err)
+
+	for _, fileName := range []string{"ramp.wav", "ramp.noseek"} {
+		r := spotifaux.NewAudioReader(os.DirFS(dir))
+		for _, frame := range []int{990, 500, 990} {
+			buf := make([]float64, 20)
+			n, err := r.Read(fileName, frame, buf)
+			assert.NoError(t, err, fileName)
+			assert.Equal(t, int(math.Min(20, float64(1000-frame))), n, fileName)
+			assert.InDeltaSlice(t, ramp[frame:frame+n], buf[:n], 1e-3, fileName)
+			n, err = r.Read(fileName, 1000, buf)
+			assert.NoError(t, err, fileName)
+			assert.Equal(t, 0, n, fileName)
+		}
+	}
+}
+
+func Test_audioReaderDropsLeastRecentlyReadFiles(t *testing.T) {
+	dir := t.TempDir()
+	ramps := map[string][]float64{}
+	for i, name := range []string{"a", "b", "c"} {
+		ramp := make([]float64, 1000)
+		for j := range ramp {
+			ramp[j] = float64(i)/4 + float64(j)/8000
+		}
+		writeTestWav(t, filepath.Join(dir, name+".noseek"), ramp, spotifaux.SAMPLE_RATE)
+		ramps[name+".noseek"] = ramp
+	}
+
+	r := spotifaux.NewAudioReader(os.DirFS(dir))
+	r.MaxBytes = 2 * 8 * 1000
+	buf := make([]float64, 10)
+	for _, step := range []struct {
+		fileName string
+		decoded  []string
+	}{
+		{"a.noseek", []string{"a.noseek"}},
+		{"b.noseek", []string{"a.noseek", "b.noseek"}},
+		{"a.noseek", []string{"b.noseek", "a.noseek"}},
+		{"c.noseek", []string{"a.noseek", "c.noseek"}},
+		{"b.noseek", []string{"c.noseek", "b.noseek"}},
+	} {
+		n, err := r.Read(step.fileName, 500, buf)
+		assert.NoError(t, err)
+		assert.Equal(t, 10, n)
+		assert.InDeltaSlice(t, ramps[step.fileName][500:510], buf, 1e-3, step.fileName)
+		assert.Equal(t, step.decoded, r.Decoded())
+	}
+
+	r = spotifaux.NewAudioReader(os.DirFS(dir))
+	r.MaxBytes = 100
+	_, err := r.Read("a.noseek", 0, buf)
+	assert.NoError(t, err)
+	assert.Empty(t, r.Decoded())
+}
@@ -0,0 +1,189 @@
+package spotifaux
+
+import (
+	"container/heap"
+	"math"
+	"sort"
+)
+
+// Candidates keeps the K best Winners for one query shingle in a bounded max-heap on MinDist.
+// Candidates from the same file closer than MinSeparation frames compete for a single slot,
+// so the K slots do not fill up with adjacent frames of the same spot.
+type Candidates struct {
+	K             int
+	MinSeparation int
+	heap          winnerHeap
+}
+
+func NewCandidates(k, minSeparation int) *Candidates {
+	if k < 1 {
+		k = 1
+	}
+	return &Candidates{K: k, MinSeparation: minSeparation}
+}
+
+// NaN distances (silent query shingles) never beat anything
+func dist(w Winner) float64 {
+	if math.IsNaN(w.MinDist) {
+		return math.Inf(1)
+	}
+	return w.MinDist
+}
+
+// better is a total order on candidates, ties going to the earlier file and position,
+// so the best candidate does not depend on the order candidates are pushed or merged in
+func better(a, b Winner) bool {
+	if dist(a) != dist(b) {
+		return dist(a) < dist(b)
+	}
+	if a.File != b.File {
+		return a.File < b.File
+	}
+	return a.Winner < b.Winner
+}
+
+// Push offers w and reports whether it was kept
+func (c *Candidates) Push(w Winner) bool {
+	if len(c.heap) == c.K && !better(w, c.heap[0]) {
+		return false
+	}
+
+	if c.MinSeparation > 0 {
+		conflicts := 0
+		for _, o := range c.heap {
+			if c.near(w, o) {
+				if !better(w, o) {
+					return false
+				}
+				conflicts++
+			}
+		}
+		if conflicts > 0 {
+			kept := c.heap[:0]
+			for _, o := range c.heap {
+				if !c.near(w, o) {
+					kept = append(kept, o)
+				}
+			}
+			c.heap = kept
+			heap.Init(&c.heap)
+		}
+	}
+
+	heap.Push(&c.heap, w)
+	if len(c.heap) > c.K {
+		heap.Pop(&c.heap)
+	}
+	return true
+}
+
+func (c *Candidates) near(a, b Winner) bool {
+	d := a.Winner - b.Winner
+	return a.File == b.File && d < c.MinSeparation && -d < c.MinSeparation
+}
+
+// Worst returns the distance a new candidate has to beat, +Inf until K candidates are kept
+func (c *Candidates) Worst() float64 {
+	if len(c.heap) < c.K {
+		return math.Inf(1)
+	}
+	return dist(c.heap[0])
+}
+
+func (c *Candidates) Len() int {
+	return len(c.heap)
+}
+
+// Winners returns the candidates best first
+func (c *Candidates) Winners() []Winner {
+	winners := make([]Winner, len(c.heap))
+	copy(winners, c.heap)
+	sort.Slice(winners, func(i, j int) bool {
+		return better(winners[i], winners[j])
+	})
+	return winners
+}
+
+// Best returns the best candidate, or a Winner of -1, which Output renders as silence, if there are none
+func (c *Candidates) Best() Winner {
+	if len(c.heap) == 0 {
+		return Winner{Winner: -1, MinDist: math.Inf(1)}
+	}
+	return c.Winners()[0]
+}
+
+// Merge offers all of o's candidates and returns how many were kept
+func (c *Candidates) Merge(o *Candidates) int {
+	kept := 0
+	for _, w := range o.Winners() {
+		if c.Push(w) {
+			kept++
+		}
+	}
+	return kept
+}
+
+// winnerHeap is a max-heap on distance, so the worst candidate is evicted first
+type winnerHeap []Winner
+
+func (h winnerHeap) Len() int            { return len(h) }
+func (h winnerHeap) Less(i, j int) bool  { return better(h[j], h[i]) }
+func (h winnerHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *winnerHeap) Push(x interface{}) { *h = append(*h, x.(Winner)) }
+func (h *winnerHeap) Pop() interface{} {
+	old := *h
+	w := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return w
+}
+
+// MatchResult holds the candidates for each query shingle
+type MatchResult struct {
+	Shingles    []*Candidates
+	ShingleSize int // frames per query shingle
+	QueryHop    int // frames between the starts of query shingles
+	Pairs       int // query shingle and database position pairs considered
+	Pruned      int // pairs skipped by their lower bound
+}
+
+func NewMatchResult(shingles int, s *SoundSpotter) *MatchResult {
+	r := &MatchResult{Shingles: make([]*Candidates, shingles), ShingleSize: s.ShingleSize, QueryHop: s.queryHop()}
+	for i := range r.Shingles {
+		r.Shingles[i] = NewCandidates(s.TopK, s.MinSeparation)
+	}
+	return r
+}
+
+// Merge combines the candidates of another database file and returns the number of shingles whose best changed
+func (r *MatchResult) Merge(o *MatchResult) int {
+	r.Pairs += o.Pairs
+	r.Pruned += o.Pruned
+	subs := 0
+	for i, c := range r.Shingles {
+		before := c.Best()
+		c.Merge(o.Shingles[i])
+		if after := c.Best(); after.File != before.File || after.Winner != before.Winner {
+			subs++
+		}
+	}
+	return subs
+}
+
+// record sets the transform of the database the candidates were matched under
+func (r *MatchResult) record(t Transform) {
+	for _, c := range r.Shingles {
+		for i := range c.heap {
+			c.heap[i].Transpose, c.heap[i].Reversed, c.heap[i].Gain = t.Transpose, t.Reversed, t.Gain
+		}
+	}
+}
+
+// Winners returns the best candidate of each shingle, with the query position of its shingle
+func (r *MatchResult) Winners() []Winner {
+	winners := make([]Winner, len(r.Shingles))
+	for i, c := range r.Shingles {
+		winners[i] = c.Best()
+		winners[i].Query = i * r.QueryHop
+	}
+	return winners
+}
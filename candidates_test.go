@@ -0,0 +1,52 @@
+package spotifaux_test
+
+import (
+	"github.com/stretchr/testify/assert"
+	"math"
+	"spotifaux"
+	"testing"
+)
+
+func Test_candidatesKeepsKBest(t *testing.T) {
+	c := spotifaux.NewCandidates(3, 0)
+	for i, d := range []float64{0.5, 0.9, 0.1, 0.7, 0.3, math.NaN()} {
+		c.Push(spotifaux.Winner{File: "a", Winner: i * 100, MinDist: d})
+	}
+	assert.Equal(t, []spotifaux.Winner{
+		{File: "a", Winner: 200, MinDist: 0.1},
+		{File: "a", Winner: 400, MinDist: 0.3},
+		{File: "a", Winner: 0, MinDist: 0.5},
+	}, c.Winners())
+	assert.Equal(t, 0.5, c.Worst())
+}
+
+func Test_candidatesMinSeparation(t *testing.T) {
+	c := spotifaux.NewCandidates(3, 5)
+	c.Push(spotifaux.Winner{File: "a", Winner: 10, MinDist: 0.5})
+	c.Push(spotifaux.Winner{File: "a", Winner: 12, MinDist: 0.4}) // replaces 10
+	c.Push(spotifaux.Winner{File: "a", Winner: 14, MinDist: 0.6}) // loses to 12
+	c.Push(spotifaux.Winner{File: "b", Winner: 12, MinDist: 0.6}) // other file
+	c.Push(spotifaux.Winner{File: "a", Winner: 17, MinDist: 0.7})
+	assert.Equal(t, []spotifaux.Winner{
+		{File: "a", Winner: 12, MinDist: 0.4},
+		{File: "b", Winner: 12, MinDist: 0.6},
+		{File: "a", Winner: 17, MinDist: 0.7},
+	}, c.Winners())
+}
+
+func Test_matchResultMerge(t *testing.T) {
+	s := &spotifaux.SoundSpotter{TopK: 2}
+	r := spotifaux.NewMatchResult(2, s)
+	o := spotifaux.NewMatchResult(2, s)
+	r.Shingles[0].Push(spotifaux.Winner{File: "a", Winner: 1, MinDist: 0.2})
+	r.Shingles[1].Push(spotifaux.Winner{File: "a", Winner: 2, MinDist: 0.2})
+	o.Shingles[0].Push(spotifaux.Winner{File: "b", Winner: 3, MinDist: 0.1})
+	o.Shingles[1].Push(spotifaux.Winner{File: "b", Winner: 4, MinDist: 0.3})
+
+	assert.Equal(t, 1, r.Merge(o))
+	assert.Equal(t, []spotifaux.Winner{
+		{File: "b", Winner: 3, MinDist: 0.1},
+		{File: "a", Winner: 2, MinDist: 0.2},
+	}, r.Winners())
+	assert.Equal(t, 2, r.Shingles[1].Len())
+}
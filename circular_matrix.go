@@ -7,7 +7,7 @@ import (
 func SeriesSum(v []float64, seqlen int) {
 
 	movingSum := 0.0
-	for spd := 0; spd < seqlen; spd++ {
+	for spd := 0; spd < seqlen && spd < len(v); spd++ {
 		movingSum += v[spd]
 	}
 
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"spotifaux"
+)
+
+const cacheUsage = `usage: runner cache [flags] command
+  size                  print the size of the cache
+  gc corpusDir...       remove features of files not in any of the corpora
+  trim                  evict least recently used features above -cache-max-mb
+  import cacheDir...    copy features missing from the cache from other caches`
+
+func cacheCommand(args []string) {
+	flags := flag.NewFlagSet("cache", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), cacheUsage)
+		flags.PrintDefaults()
+	}
+	addCorpusFlags(flags)
+	addCacheFlags(flags)
+	err := flags.Parse(args)
+	if err != nil {
+		panic(err)
+	}
+	if flags.NArg() == 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	e := spotifaux.NewFeatureExtractor(spotifaux.SAMPLE_RATE)
+	cache := openCache(e)
+
+	switch flags.Arg(0) {
+	case "size":
+		size, err := cache.Size()
+		if err != nil {
+			panic(err)
+		}
+		fmt.Printf("%s %.1f MB\n", cache.Dir, float64(size)/(1<<20))
+
+	case "gc":
+		if flags.NArg() < 2 {
+			flags.Usage()
+			os.Exit(2)
+		}
+		var keep []string
+		for _, dirname := range flags.Args()[1:] {
+			corpus := getCorpus(dirname)
+			for _, fileName := range dbAudioFiles(corpus) {
+				datFileName, err := cache.Path(corpus, fileName)
+				if err != nil {
+					panic(err)
+				}
+				keep = append(keep, datFileName)
+			}
+		}
+		freed, err := cache.GC(keep)
+		if err != nil {
+			panic(err)
+		}
+		fmt.Printf("freed %.1f MB\n", float64(freed)/(1<<20))
+
+	case "trim":
+		freed, err := cache.Trim()
+		if err != nil {
+			panic(err)
+		}
+		fmt.Printf("freed %.1f MB\n", float64(freed)/(1<<20))
+
+	case "import":
+		for _, dir := range flags.Args()[1:] {
+			imported, err := cache.Import(dir)
+			if err != nil {
+				panic(err)
+			}
+			fmt.Printf("imported %d from %s\n", imported, dir)
+		}
+
+	default:
+		flags.Usage()
+		os.Exit(2)
+	}
+}
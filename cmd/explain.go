@@ -0,0 +1,207 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"runtime"
+	"sort"
+	"spotifaux"
+	"strconv"
+	"strings"
+)
+
+const explainUsage = `usage: runner explain [flags] clip recipe.json (featureFile | corpusDir)...
+  breaks down the distance of each unit of a recipe made from clip by feature and by frame, as JSON`
+
+func explainCommand(args []string) {
+	flags := flag.NewFlagSet("explain", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), explainUsage)
+		flags.PrintDefaults()
+	}
+	unit := flags.Int("unit", -1, "index of the recipe unit to explain, -1 for every matched unit")
+	var features intList
+	flags.Var(&features, "features", "comma separated coefficients to compare, those the runner matches if not given")
+	shingleSize := flags.Int("shingle-size", 11, "frames per query shingle of the recipe")
+	distance := flags.String("distance", "",
+		"matched-filter, cosine, squared-euclidean, manhattan or mahalanobis, the recipe's if not given")
+	powerWeight := flags.Float64("power-weight", 0,
+		"add this much distance per dB of loudness difference, the recipe's if not given with -distance")
+	topK := flags.Int("top-k", 10, "candidates each unit is ranked among, 0 to not rank")
+	matcher := &spotifaux.CorpusMatcher{}
+	flags.IntVar(&matcher.Workers, "workers", runtime.NumCPU(), "database files matched concurrently")
+	timeout := flags.Duration("timeout", 0, "give up after this long, 0 for no limit")
+	addCorpusFlags(flags)
+	addCacheFlags(flags)
+	err := flags.Parse(args)
+	if err != nil {
+		panic(err)
+	}
+	if flags.NArg() < 3 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	ctx, cancel := interruptible(*timeout)
+	defer cancel()
+
+	recipe := readRecipe(flags.Arg(1))
+	if *distance == "" {
+		var weight float64
+		*distance, weight = recipeDistance(recipe.Distance)
+		if *powerWeight == 0 {
+			*powerWeight = weight
+		}
+	}
+
+	e := spotifaux.NewFeatureExtractor(spotifaux.SAMPLE_RATE)
+	clip := flags.Arg(0)
+	clipDatFileName := audioDat(ctx, e, openCache(e), clip)
+	if len(features) == 0 {
+		features = chosenFeatures
+	}
+	s := &spotifaux.SoundSpotter{
+		ChosenFeatures: features,
+		CqtN:           e.CqtN,
+		ShingleSize:    *shingleSize,
+		InShingles:     readQuery(clipDatFileName, e.CqtN),
+	}
+	if *powerWeight != 0 {
+		s.InPowers, err = spotifaux.ReadPowers(clipDatFileName)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	hop := recipe.Hop
+	if hop == 0 {
+		hop = s.ShingleSize
+	}
+	units := recipe.Winner
+	for i := range units {
+		if recipe.Hop == 0 {
+			units[i].Query = i * s.ShingleSize
+		}
+	}
+	if *unit >= 0 {
+		if *unit >= len(units) {
+			panic(fmt.Sprintf("the recipe has %d units", len(units)))
+		}
+		units = units[*unit : *unit+1]
+	}
+
+	// the transforms the units were matched under, to match the query under each of them
+	semitones := 0
+	transposes := map[int]bool{}
+	gains := map[float64]bool{}
+	reverse := false
+	for _, w := range units {
+		if w.Query >= len(s.InShingles) {
+			panic(fmt.Sprintf("the recipe was not made from %s, which has no frame %d", clip, w.Query))
+		}
+		if k := w.Transpose; k != 0 {
+			transposes[k] = true
+			if k < 0 {
+				k = -k
+			}
+			if k > semitones {
+				semitones = k
+			}
+		}
+		if w.Gain != 0 {
+			gains[w.Gain] = true
+		}
+		reverse = reverse || w.Reversed
+	}
+	s.InTransposed = transposedQueries(ctx, clip, semitones)
+
+	sources := featureSources(ctx, e, flags.Args()[2:])
+	files := make([]string, len(sources))
+	datFiles := map[string]string{}
+	for i, source := range sources {
+		files[i], datFiles[source.Name] = source.Name, source.DatFileName
+	}
+	s.Distance = matchDistance(*distance, *powerWeight, s, files, datFiles)
+	if recipe.Distance != "" && s.Distance.Name() != recipe.Distance {
+		panic(fmt.Sprintf("the recipe was made with the %s distance, not %s", recipe.Distance, s.Distance.Name()))
+	}
+
+	// the query is matched once for each unit length, as the runner matched it, and each unit is ranked
+	// among the candidates of its query shingle
+	matched := map[int]*spotifaux.MatchResult{}
+	if *topK > 0 {
+		t := *s
+		t.QueryHop, t.TopK, t.Reverse = hop, *topK, reverse
+		t.GainOffsets = nil
+		for gain := range gains {
+			t.GainOffsets = append(t.GainOffsets, gain)
+		}
+		sort.Float64s(t.GainOffsets)
+		t.InTransposed = map[int][][]float64{}
+		for k := range transposes {
+			t.InTransposed[k] = s.InTransposed[k]
+		}
+		for _, w := range units {
+			span := w.Span
+			if span == 0 {
+				span = s.ShingleSize
+			}
+			if matched[span] != nil || w.Winner < 0 || w.Fallback != "" {
+				continue
+			}
+			t.ShingleSize = span
+			matched[span], err = matcher.MatchContext(ctx, sources, &t, printProgress("matching"))
+			if err != nil {
+				panic(err)
+			}
+		}
+	}
+
+	explanations := []*spotifaux.Explanation{}
+	for _, w := range units {
+		if *unit < 0 && (w.Winner < 0 || w.Fallback != "") {
+			continue
+		}
+
+		var candidates *spotifaux.Candidates
+		span := w.Span
+		if span == 0 {
+			span = s.ShingleSize
+		}
+		if result := matched[span]; result != nil && w.Query%hop == 0 && w.Query/hop < len(result.Shingles) {
+			candidates = result.Shingles[w.Query/hop]
+		}
+
+		explanation, err := s.Explain(sources, w, candidates)
+		if err != nil {
+			panic(err)
+		}
+		explanations = append(explanations, explanation)
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	err = enc.Encode(explanations)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// recipeDistance splits the name of the distance a recipe was made with into the -distance and
+// -power-weight that make it
+func recipeDistance(name string) (string, float64) {
+	if name == "" {
+		return "matched-filter", 0 // recipes from before the distance was recorded
+	}
+	i := strings.Index(name, "+power(")
+	if i < 0 || !strings.HasSuffix(name, ")") {
+		return name, 0
+	}
+	weight, err := strconv.ParseFloat(name[i+len("+power("):len(name)-1], 64)
+	if err != nil {
+		panic(fmt.Sprintf("unknown distance %q", name))
+	}
+	return name[:i], weight
+}
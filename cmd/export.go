@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"spotifaux"
+	"strings"
+)
+
+const exportUsage = `usage: runner export [flags] (featureFile | corpusDir)...
+  exports dat or npy feature files, or the features of every file in a corpus`
+
+var exporters = map[string]func(w io.Writer, sources []spotifaux.FeatureSource, cqtN int) error{
+	"csv":   spotifaux.ExportCSV,
+	"jsonl": spotifaux.ExportJSONL,
+	"npy":   spotifaux.ExportNpy,
+	"npz":   spotifaux.ExportNpz,
+}
+
+func exportCommand(args []string) {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), exportUsage)
+		flags.PrintDefaults()
+	}
+	format := flags.String("format", "", "csv, jsonl, npy or npz (default from -o, else jsonl)")
+	out := flags.String("o", "", "output file (default stdout)")
+	addCorpusFlags(flags)
+	addCacheFlags(flags)
+	err := flags.Parse(args)
+	if err != nil {
+		panic(err)
+	}
+	if flags.NArg() == 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	if *format == "" {
+		*format = strings.TrimPrefix(filepath.Ext(*out), ".")
+	}
+	if *format == "" {
+		*format = "jsonl"
+	}
+	export, ok := exporters[*format]
+	if !ok {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	e := spotifaux.NewFeatureExtractor(spotifaux.SAMPLE_RATE)
+	sources := featureSources(context.Background(), e, flags.Args())
+
+	w := os.Stdout
+	if *out != "" {
+		w, err = os.Create(*out)
+		if err != nil {
+			panic(err)
+		}
+		defer w.Close()
+	}
+
+	err = export(w, sources, e.CqtN)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// featureSources resolves feature files as themselves and corpus directories through the feature cache
+func featureSources(ctx context.Context, e *spotifaux.FeatureExtractor, paths []string) []spotifaux.FeatureSource {
+	var sources []spotifaux.FeatureSource
+	var cache *spotifaux.FeatureCache
+	for _, p := range paths {
+		fi, err := os.Stat(p)
+		if err != nil {
+			panic(err)
+		}
+		if !fi.IsDir() {
+			sources = append(sources, spotifaux.FeatureSource{Name: p, DatFileName: p})
+			continue
+		}
+
+		if cache == nil {
+			cache = openCache(e)
+		}
+		corpus := getCorpus(p)
+		files := dbAudioFiles(corpus)
+		datFiles := dbAudioToDats(ctx, e, corpus, files, cache)
+		for _, fileName := range files {
+			sources = append(sources, spotifaux.FeatureSource{Name: fileName, DatFileName: datFiles[fileName]})
+		}
+	}
+	return sources
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"spotifaux"
+)
+
+const inspectUsage = `usage: runner inspect [flags] (featureFile | audioFile)...
+  prints the contents of feature files, audio files are looked up in the feature cache`
+
+func inspectCommand(args []string) {
+	flags := flag.NewFlagSet("inspect", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), inspectUsage)
+		flags.PrintDefaults()
+	}
+	verify := flags.Bool("verify", false, "re-extract frames of audio files and compare them to the stored features")
+	samples := flags.Int("samples", 32, "frames to re-extract with -verify")
+	width := flags.Int("width", 72, "width of the energy sparkline")
+	addCacheFlags(flags)
+	err := flags.Parse(args)
+	if err != nil {
+		panic(err)
+	}
+	if flags.NArg() == 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	e := spotifaux.NewFeatureExtractor(spotifaux.SAMPLE_RATE)
+	var cache *spotifaux.FeatureCache
+
+	failed := false
+	for _, fileName := range flags.Args() {
+		datFileName := fileName
+		if spotifaux.IsAudioFile(fileName) {
+			if cache == nil {
+				cache = openCache(e)
+			}
+			datFileName, err = cache.Dat(e, spotifaux.OpenCorpus(filepath.Dir(fileName)), filepath.Base(fileName))
+			if err != nil {
+				panic(err)
+			}
+			fmt.Printf("%s (%s)\n", fileName, datFileName)
+		} else {
+			fmt.Println(fileName)
+		}
+
+		info, err := spotifaux.InspectDat(datFileName, e.CqtN)
+		if err != nil {
+			panic(err)
+		}
+		printDatInfo(info, *width)
+		failed = failed || !info.Consistent()
+
+		if *verify && spotifaux.IsAudioFile(fileName) {
+			result, err := e.VerifyDat(os.DirFS(filepath.Dir(fileName)), filepath.Base(fileName), datFileName, *samples)
+			if err != nil {
+				panic(err)
+			}
+			fmt.Printf("  verify: %d frames expected, %d of %d sampled frames match, max diff %.4f\n",
+				result.ExpectedFrames, len(result.Checked)-len(result.Mismatched), len(result.Checked), result.MaxDiff)
+			if len(result.Mismatched) > 0 {
+				fmt.Printf("  mismatched frames %v\n", result.Mismatched)
+			}
+			failed = failed || len(result.Mismatched) > 0 || result.ExpectedFrames != info.Frames
+		}
+	}
+
+	if failed {
+		os.Exit(1)
+	}
+}
+
+func printDatInfo(info *spotifaux.DatInfo, width int) {
+	consistent := "ok"
+	if !info.Consistent() {
+		consistent = "MISMATCH"
+	}
+	fmt.Printf("  frames %d (%.2fs), %d coefficients\n", info.Frames, spotifaux.FrameTime(info.Frames), info.CqtN)
+	fmt.Printf("  size %d bytes, header implies %d: %s\n", info.Size, info.ExpectedSize, consistent)
+	fmt.Printf("  silent frames %d, NaN frames %d\n", info.SilentFrames, info.NaNFrames)
+	fmt.Printf("  %4s %8s %8s %8s\n", "coef", "min", "max", "mean")
+	for i := 0; i < info.CqtN; i++ {
+		fmt.Printf("  %4d %8.4f %8.4f %8.4f\n", i, info.Min[i], info.Max[i], info.Mean[i])
+	}
+	fmt.Printf("  energy %s\n", spotifaux.Sparkline(info.Energy, width))
+}
@@ -1,213 +1,646 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
-	"github.com/faiface/beep"
-	"github.com/faiface/beep/effects"
-	"github.com/faiface/beep/mp3"
-	"github.com/faiface/beep/wav"
-	"io"
 	"io/ioutil"
-	"log"
 	"math"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
 	"spotifaux"
+	"strconv"
 	"strings"
 	"time"
 )
 
-func getDBDirname() string {
-	if len(os.Args) > 1 {
-		return os.Args[1]
-	} else {
-		return "/Users/wyatttall/git/spotifaux/The Beatles"
+type globList []string
+
+func (g *globList) String() string {
+	return strings.Join(*g, ",")
+}
+
+func (g *globList) Set(glob string) error {
+	*g = append(*g, glob)
+	return nil
+}
+
+var include, exclude globList
+
+type floatList []float64
+
+func (f *floatList) String() string {
+	return fmt.Sprint(*f)
+}
+
+func (f *floatList) Set(list string) error {
+	for _, v := range strings.Split(list, ",") {
+		x, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		if err != nil {
+			return err
+		}
+		*f = append(*f, x)
 	}
+	return nil
 }
 
-func main() {
-	sourceWavFileName := "/Users/wyatttall/git/spotifaux/recreate/kick.wav"
+type intList []int
 
-	e := spotifaux.NewFeatureExtractor(spotifaux.SAMPLE_RATE)
-	s := &spotifaux.SoundSpotter{
-		ChosenFeatures: []int{3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20},
-		CqtN:           e.CqtN,
-		ShingleSize:    11,
+func (l *intList) String() string {
+	return fmt.Sprint(*l)
+}
+
+func (l *intList) Set(list string) error {
+	for _, v := range strings.Split(list, ",") {
+		x, err := strconv.Atoi(strings.TrimSpace(v))
+		if err != nil {
+			return err
+		}
+		*l = append(*l, x)
 	}
+	return nil
+}
 
-	//dbMp3sToWavs()
-	dbWavsToDats(e)
+func addCorpusFlags(flags *flag.FlagSet) {
+	flags.Var(&include, "include", "glob of corpus files to use, repeatable")
+	flags.Var(&exclude, "exclude", "glob of corpus files or directories to skip, repeatable")
+}
 
-	err := e.ExtractSeriesOfVectors(sourceWavFileName, toDat(sourceWavFileName))
+var cacheDir string
+var cacheMaxMB int64
+
+func addCacheFlags(flags *flag.FlagSet) {
+	dir, err := os.UserCacheDir()
 	if err != nil {
-		panic(err)
+		dir = os.TempDir()
 	}
-
-	sourceDatToRecipe(toDat(sourceWavFileName), s)
-	recipeToOutput(sourceWavFileName, s)
+	flags.StringVar(&cacheDir, "cache", filepath.Join(dir, "spotifaux"), "feature cache directory")
+	flags.Int64Var(&cacheMaxMB, "cache-max-mb", 0, "evict least recently used features above this size, 0 for no limit")
 }
 
-func dbMp3sToWavs() {
-	dirname := getDBDirname()
-	files, err := ioutil.ReadDir(dirname)
+func openCache(e *spotifaux.FeatureExtractor) *spotifaux.FeatureCache {
+	cache, err := spotifaux.NewFeatureCache(cacheDir, e)
 	if err != nil {
 		panic(err)
 	}
+	cache.MaxBytes = cacheMaxMB << 20
+	return cache
+}
 
-	for i, fi := range files {
-		if strings.HasSuffix(fi.Name(), ".mp3") {
-			fmt.Printf("%d of %d %s to wav\n", i, len(files), fi.Name())
+var indexFileName string
+var indexTables, indexBits, indexProbes int
 
-			f, err := os.Open(dirname + "/" + fi.Name())
-			if err != nil {
-				panic(err)
-			}
+func addIndexFlags(flags *flag.FlagSet) {
+	flags.StringVar(&indexFileName, "index", "", "match through this shingle index, built when missing or out of date")
+	flags.IntVar(&indexTables, "index-tables", 8, "hash tables of a new index, more for better recall")
+	flags.IntVar(&indexBits, "index-bits", 16, "bits per hash of a new index, more for faster and less exact queries")
+	flags.IntVar(&indexProbes, "index-probes", 2, "neighbouring buckets searched per table, more for better recall")
+}
 
-			streamer, _, err := mp3.Decode(f)
-			if err != nil {
-				log.Fatal(err)
-			}
+// openIndex loads the index at indexFileName, rebuilding it if it does not cover sources
+func openIndex(ctx context.Context, sources []spotifaux.FeatureSource, s *spotifaux.SoundSpotter) *spotifaux.ShingleIndex {
+	ix, err := spotifaux.LoadShingleIndex(indexFileName)
+	if err != nil || !ix.Covers(sources, s) {
+		fmt.Fprintf(os.Stderr, "indexing %d files to %s\n", len(sources), indexFileName)
+		ix, err = spotifaux.BuildShingleIndexContext(ctx, sources, s, indexTables, indexBits, 1, printProgress("indexing"))
+		if err != nil {
+			panic(err)
+		}
+		err = ix.Save(indexFileName)
+		if err != nil {
+			panic(err)
+		}
+	}
+	ix.Probes = indexProbes
+	return ix
+}
 
-			monoStreamer := effects.Mono(streamer)
+var commands = map[string]func(args []string){
+	"cache":   cacheCommand,
+	"explain": explainCommand,
+	"export":  exportCommand,
+	"inspect": inspectCommand,
+	"search":  searchCommand,
+}
 
-			out, err := os.Create(dirname + "/" + fi.Name()[0:strings.LastIndex(fi.Name(), ".")] + ".wav")
-			if err != nil {
-				panic(err)
-			}
+// chosenFeatures are the coefficients matched
+var chosenFeatures = []int{3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20}
 
-			r := beep.Resample(6, beep.SampleRate(48000), beep.SampleRate(16000), monoStreamer)
+func getDBDirname() string {
+	if flag.NArg() > 0 {
+		return flag.Arg(0)
+	} else {
+		return "/Users/wyatttall/git/spotifaux/The Beatles"
+	}
+}
 
-			err = wav.Encode(out, r, beep.Format{
-				SampleRate:  beep.SampleRate(16000),
-				NumChannels: 1,
-				Precision:   1,
-			})
-			if err != nil {
-				panic(err)
-			}
+func getCorpus(dirname string) *spotifaux.Corpus {
+	corpus := spotifaux.OpenCorpus(dirname)
+	corpus.Include = include
+	corpus.Exclude = exclude
+	return corpus
+}
 
-			streamer.Close()
-			f.Close()
-			out.Close()
+func main() {
+	defer exitIfCancelled()
+	if len(os.Args) > 1 {
+		if command, ok := commands[os.Args[1]]; ok {
+			command(os.Args[2:])
+			return
 		}
 	}
-}
 
-func dbWavsToDats(e *spotifaux.FeatureExtractor) {
+	addCorpusFlags(flag.CommandLine)
+	addCacheFlags(flag.CommandLine)
+	addIndexFlags(flag.CommandLine)
+	matcher := &spotifaux.CorpusMatcher{}
+	flag.IntVar(&matcher.Workers, "workers", runtime.NumCPU(), "database files matched concurrently")
+	flag.IntVar(&matcher.ChunkFrames, "chunk-frames", 30000, "split longer database files between workers, 0 to never split")
+	backend := flag.String("backend", "auto", "matcher backend: auto, direct, fft or quantized")
+	prune := flag.Int("prune", 0, "features in the lower bound used to skip hopeless positions, 0 to compare all")
+	distance := flag.String("distance", "matched-filter",
+		"matched-filter, cosine, squared-euclidean, manhattan or mahalanobis")
+	powerWeight := flag.Float64("power-weight", 0, "add this much distance per dB of loudness difference")
+	diversity := &spotifaux.Diversity{}
+	flag.IntVar(&diversity.MaxUses, "max-uses", 0, "times the same corpus position may be used, 0 for no limit")
+	flag.IntVar(&diversity.MinGap, "min-gap", 0, "query frames before a corpus position may be used again")
+	flag.Float64Var(&diversity.MaxFileShare, "max-file-share", 0,
+		"largest fraction of the output from one corpus file, 0 for no limit")
+	excludeQuery := flag.Bool("exclude-query", false, "leave copies of the query out of the corpus")
+	queryHop := flag.Int("query-hop", 0, "frames between query shingles, the shingle size if 0")
+	stretch := flag.Float64("stretch", 1,
+		"time warp query shingles to corpus windows up to this ratio longer or shorter, 1 for rigid")
+	warpBand := flag.Int("warp-band", 0, "frames a time warp may stray from the diagonal, 0 for no limit beyond -stretch")
+	topK := flag.Int("top-k", 0, "candidates kept per query shingle for unit selection, reuse limits and "+
+		"-temperature to choose from, 0 for 10 with any of them and 1 otherwise")
+	minSeparation := flag.Int("min-separation", 0,
+		"frames apart the -top-k candidates from one corpus file must be, 0 to allow neighbours")
+	selector := &spotifaux.UnitSelector{}
+	flag.Float64Var(&selector.TargetWeight, "target-weight", 1, "unit selection weight of each unit's distance")
+	flag.Float64Var(&selector.ConcatWeight, "concat-weight", 0,
+		"unit selection weight of spectral jumps between units, 0 with no -contiguity-bonus to take each shingle's best")
+	flag.Float64Var(&selector.ContiguityBonus, "contiguity-bonus", 0, "unit selection bonus for carrying on in the same file")
+	sampler := &spotifaux.Sampler{}
+	flag.Float64Var(&sampler.Temperature, "temperature", 0,
+		"draw each shingle's winner from its -top-k candidates, more often worse ones the higher, 0 for the best")
+	flag.Int64Var(&sampler.Seed, "seed", 1, "random seed of the first variation drawn with -temperature")
+	variations := flag.Int("variations", 1, "recipes drawn with -temperature from one match, each with the next seed")
+	maxDistance := flag.Float64("max-distance", 0, "drop candidates further than this, 0 for no limit")
+	fallback := flag.String("fallback", "silence",
+		"for shingles without a candidate: silence, passthrough, hold or corpus")
+	fallbackDir := flag.String("fallback-corpus", "", "directory of the corpus searched by -fallback corpus")
+	transpose := flag.Int("transpose", 0, "also match the corpus transposed by up to this many semitones either way")
+	reverse := flag.Bool("reverse", false, "also match the corpus played backwards")
+	var gainOffsets floatList
+	flag.Var(&gainOffsets, "gain-offsets", "comma separated dB the corpus is also matched louder by, with -power-weight")
+	multiScale := &spotifaux.MultiScale{}
+	flag.Var((*intList)(&multiScale.ShingleSizes), "scales",
+		"comma separated shingle sizes to match at, covering the query with the longest units that are close enough")
+	flag.Float64Var(&multiScale.Tolerance, "scale-tolerance", 0.05,
+		"distance a longer unit of -scales may be further than the best shortest one")
+	timeout := flag.Duration("timeout", 0, "give up after this long, 0 for no limit")
+	flag.Parse()
+
+	ctx, cancel := interruptible(*timeout)
+	defer cancel()
+
+	chooses := selector.ConcatWeight != 0 || selector.ContiguityBonus != 0 || sampler.Temperature > 0 ||
+		diversity.MaxUses > 0 || diversity.MinGap > 0 || diversity.MaxFileShare > 0
+	if *topK == 0 {
+		*topK = 1
+		if chooses {
+			*topK = 10
+		}
+	}
+
+	if sampler.Temperature > 0 && (selector.ConcatWeight != 0 || selector.ContiguityBonus != 0) {
+		panic("-temperature draws winners shingle by shingle, so cannot be combined with unit selection")
+	}
+	if len(multiScale.ShingleSizes) > 0 && (indexFileName != "" || chooses) {
+		panic("-scales picks units from a match at each size, " +
+			"so cannot be combined with -index, -temperature, unit selection or reuse limits")
+	}
+
+	sourceFileName := "/Users/wyatttall/git/spotifaux/recreate/kick.wav"
+
+	e := spotifaux.NewFeatureExtractor(spotifaux.SAMPLE_RATE)
+	s := &spotifaux.SoundSpotter{
+		ChosenFeatures: chosenFeatures,
+		CqtN:           e.CqtN,
+		ShingleSize:    11,
+		QueryHop:       *queryHop,
+		TopK:           *topK,
+		MinSeparation:  *minSeparation,
+		Backend:        matchBackend(*backend),
+		PruneFeatures:  *prune,
+		MaxStretch:     *stretch,
+		WarpBand:       *warpBand,
+		MaxDistance:    *maxDistance,
+		Fallback:       matchFallback(*fallback),
+		Reverse:        *reverse,
+		GainOffsets:    gainOffsets,
+	}
+
+	cache := openCache(e)
+	corpus := getCorpus(getDBDirname())
+	files := dbAudioFiles(corpus)
+	datFiles := dbAudioToDats(ctx, e, corpus, files, cache)
+
+	sourceDatFileName := audioDat(ctx, e, cache, sourceFileName)
+
+	s.InTransposed = transposedQueries(ctx, sourceFileName, *transpose)
+
+	if *excludeQuery {
+		diversity.ExcludeDat = sourceDatFileName
+	}
+	s.Distance = matchDistance(*distance, *powerWeight, s, files, datFiles)
+	var fallbackCorpus *spotifaux.Corpus
+	var fallbackSources []spotifaux.FeatureSource
+	if s.Fallback == spotifaux.FallbackCorpus {
+		if *fallbackDir == "" {
+			panic("-fallback corpus needs a -fallback-corpus")
+		}
+		fallbackCorpus = getCorpus(*fallbackDir)
+		fallbackFiles := dbAudioFiles(fallbackCorpus)
+		fallbackSources = featureSourcesOf(fallbackFiles, dbAudioToDats(ctx, e, fallbackCorpus, fallbackFiles,
+			cache))
+	}
 
-	dirname := getDBDirname()
-	files, err := ioutil.ReadDir(dirname)
+	recipeFileNames := sourceDatToRecipe(ctx, sourceDatFileName, s, matcher, selector, diversity, sampler, multiScale,
+		*variations, files, datFiles, fallbackSources)
+	for v, recipeFileName := range recipeFileNames {
+		recipeToOutput(ctx, sourceFileName, recipeFileName, variationName("out", ".wav", v, len(recipeFileNames)), s,
+			corpus, fallbackCorpus)
+	}
+
+	_, err := cache.Trim()
 	if err != nil {
 		panic(err)
 	}
+}
 
-	for i, fi := range files {
-		if strings.HasSuffix(fi.Name(), ".wav") {
-			fmt.Printf("%d of %d %s to dat\n", i, len(files), fi.Name())
+// interruptible returns a context cancelled by the first interrupt, after which a second one kills as
+// usual, or once timeout has passed if it is not 0
+func interruptible(timeout time.Duration) (context.Context, context.CancelFunc) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+	if timeout <= 0 {
+		return ctx, stop
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	return ctx, func() {
+		cancel()
+		stop()
+	}
+}
 
-			err = e.ExtractSeriesOfVectors(dirname+"/"+fi.Name(), toDat(dirname+"/"+fi.Name()))
-			if err != nil {
-				panic(err)
-			}
+// exitIfCancelled turns the panic of work stopped by the context of interruptible into a message and a
+// failing exit status rather than a stack trace, and passes on any other panic
+func exitIfCancelled() {
+	r := recover()
+	if r == nil {
+		return
+	}
+	if err, ok := r.(error); ok {
+		if errors.Is(err, context.Canceled) {
+			fmt.Fprintln(os.Stderr, "interrupted")
+			os.Exit(130)
+		}
+		if errors.Is(err, context.DeadlineExceeded) {
+			fmt.Fprintln(os.Stderr, "timed out")
+			os.Exit(1)
+		}
+	}
+	panic(r)
+}
+
+func matchBackend(name string) spotifaux.MatchBackend {
+	for _, backend := range []spotifaux.MatchBackend{spotifaux.BackendAuto, spotifaux.BackendDirect, spotifaux.BackendFFT,
+		spotifaux.BackendQuantized} {
+		if backend.String() == name {
+			return backend
+		}
+	}
+	panic(fmt.Sprintf("unknown backend %q", name))
+}
+
+func matchFallback(name string) spotifaux.Fallback {
+	for _, fallback := range []spotifaux.Fallback{spotifaux.FallbackSilence, spotifaux.FallbackPassthrough,
+		spotifaux.FallbackHold, spotifaux.FallbackCorpus} {
+		if fallback.String() == name {
+			return fallback
 		}
 	}
+	panic(fmt.Sprintf("unknown fallback %q", name))
 }
 
-func toDat(fileName string) string {
-	return fileName[0:strings.LastIndex(fileName, ".")] + ".dat"
+func matchDistance(name string, powerWeight float64, s *spotifaux.SoundSpotter, files []string,
+	datFiles map[string]string) spotifaux.Distance {
+
+	var d spotifaux.Distance
+	switch name {
+	case "matched-filter":
+		d = spotifaux.MatchedFilter{}
+	case "cosine":
+		d = spotifaux.Cosine{}
+	case "squared-euclidean":
+		d = spotifaux.SquaredEuclidean{}
+	case "manhattan":
+		d = spotifaux.Manhattan{}
+	case "mahalanobis":
+		cov, err := spotifaux.CorpusCovariance(featureSourcesOf(files, datFiles), s)
+		if err != nil {
+			panic(err)
+		}
+		d, err = spotifaux.NewMahalanobis(cov, 1e-3)
+		if err != nil {
+			panic(err)
+		}
+	default:
+		panic(fmt.Sprintf("unknown distance %q", name))
+	}
+
+	if powerWeight != 0 {
+		d = spotifaux.PowerAware{Base: d, Weight: powerWeight}
+	}
+	return d
 }
 
-func sourceDatToRecipe(sourceDatFileName string, s *spotifaux.SoundSpotter) {
+func featureSourcesOf(files []string, datFiles map[string]string) []spotifaux.FeatureSource {
+	sources := make([]spotifaux.FeatureSource, len(files))
+	for i, fileName := range files {
+		sources[i] = spotifaux.FeatureSource{Name: fileName, DatFileName: datFiles[fileName]}
+	}
+	return sources
+}
 
-	source, err := spotifaux.NewDatReader(sourceDatFileName, s.CqtN)
+func dbAudioFiles(corpus *spotifaux.Corpus) []string {
+	files, err := corpus.Files()
 	if err != nil {
 		panic(err)
 	}
+	return files
+}
 
-	x := source.Frames
-	if x%s.ShingleSize > 0 {
-		x += s.ShingleSize - source.Frames%s.ShingleSize
-	}
-	s.InShingles = make([][]float64, x)
+// dbAudioToDats returns the cached dat file of each corpus file, extracting any that are missing
+func dbAudioToDats(ctx context.Context, e *spotifaux.FeatureExtractor, corpus *spotifaux.Corpus, files []string,
+	cache *spotifaux.FeatureCache) map[string]string {
 
-	for d := 0; d < x; d++ {
-		s.InShingles[d], err = source.Dat()
-		if err == io.EOF {
-			s.InShingles[d] = make([]float64, s.CqtN)
-		} else if err != nil {
-			panic(err)
-		}
+	datFileNames, err := cache.Dats(ctx, e, corpus, files, printProgress("extracting"))
+	if err != nil {
+		panic(err)
+	}
+	datFiles := map[string]string{}
+	for i, fileName := range files {
+		datFiles[fileName] = datFileNames[i]
 	}
 
-	err = source.Close()
+	err = cache.SaveIndex()
 	if err != nil {
 		panic(err)
 	}
+	return datFiles
+}
 
-	dirname := getDBDirname()
-	files, err := ioutil.ReadDir(dirname)
+// audioDat returns the dat of the audio file fileName from cache, extracting it on a miss
+func audioDat(ctx context.Context, e *spotifaux.FeatureExtractor, cache *spotifaux.FeatureCache, fileName string) string {
+	datFileNames, err := cache.Dats(ctx, e, spotifaux.OpenCorpus(filepath.Dir(fileName)), []string{filepath.Base(fileName)}, nil)
 	if err != nil {
 		panic(err)
 	}
+	return datFileNames[0]
+}
+
+// printProgress prints progress to stderr about once a second and when the last file is done, with the
+// mean of the best distances of the query shingles so far when matching
+func printProgress(label string) spotifaux.ProgressFunc {
+	var last time.Time
+	return func(p spotifaux.Progress) {
+		if time.Since(last) < time.Second && p.Files < p.TotalFiles {
+			return
+		}
+		last = time.Now()
 
-	x = len(s.InShingles) / s.ShingleSize
-	if len(s.InShingles)%s.ShingleSize > 0 {
-		x++
+		line := fmt.Sprintf("%s: %d of %d files", label, p.Files, p.TotalFiles)
+		if p.TotalFrames > 0 {
+			line += fmt.Sprintf(", %.0f%% of frames", 100*float64(p.Frames)/float64(p.TotalFrames))
+		}
+		sum, n := 0.0, 0
+		for _, d := range p.Best {
+			if !math.IsInf(d, 0) {
+				sum += d
+				n++
+			}
+		}
+		if n > 0 {
+			line += fmt.Sprintf(", mean best distance %.4f", sum/float64(n))
+		}
+		if p.Remaining > 0 {
+			line += fmt.Sprintf(", %s left", p.Remaining.Round(time.Second))
+		}
+		fmt.Fprintln(os.Stderr, line)
 	}
+}
 
-	totalTime := time.Duration(0)
-	wavCount := 0
+// sourceDatToRecipe matches the source against the corpus once and writes a recipe for each variation,
+// returning their file names
+func sourceDatToRecipe(ctx context.Context, sourceDatFileName string, s *spotifaux.SoundSpotter, matcher *spotifaux.CorpusMatcher,
+	selector *spotifaux.UnitSelector, diversity *spotifaux.Diversity, sampler *spotifaux.Sampler,
+	multiScale *spotifaux.MultiScale, variations int, files []string, datFiles map[string]string,
+	fallbackSources []spotifaux.FeatureSource) []string {
+
+	var err error
+	s.InShingles = readQuery(sourceDatFileName, s.CqtN)
+	if _, ok := s.Distance.(spotifaux.PowerAware); ok {
+		s.InPowers, err = spotifaux.ReadPowers(sourceDatFileName)
+		if err != nil {
+			panic(err)
+		}
+	}
 
-	winners := make([]spotifaux.Winner, x)
-	for i, fi := range files {
-		if strings.HasSuffix(fi.Name(), ".wav") {
+	sources := diversity.Sources(featureSourcesOf(files, datFiles))
+
+	var result *spotifaux.MatchResult
+	var scales []*spotifaux.MatchResult
+	start := time.Now()
+	if len(multiScale.ShingleSizes) > 0 {
+		scales, err = multiScale.Match(ctx, matcher, sources, s, printProgress("matching"))
+		if err == nil {
+			result = scales[0]
+		}
+	} else if indexFileName != "" {
+		result, err = openIndex(ctx, sources, s).MatchContext(ctx, s, printProgress("matching"))
+	} else {
+		result, err = matcher.MatchContext(ctx, sources, s, printProgress("matching"))
+	}
+	if err != nil {
+		panic(err)
+	}
+	matched := len(sources)
+
+	result = s.Threshold(result)
+	for k := range scales {
+		scales[k] = s.Threshold(scales[k])
+	}
 
-			start := time.Now()
-			wavFileName := dirname + "/" + fi.Name()
-			fileWinners, err := spotifaux.Match(wavFileName, toDat(wavFileName), s)
+	if sampler.Temperature <= 0 {
+		variations = 1
+	}
+	recipes := make([]spotifaux.Recipe, variations)
+	var units []spotifaux.Winner
+	for v := range recipes {
+		recipe := spotifaux.Recipe{Distance: s.Distance.Name(), Hop: result.QueryHop}
+		if scales != nil {
+			recipe.Winner = multiScale.Winners(scales)
+		} else if selector.ConcatWeight != 0 || selector.ContiguityBonus != 0 {
+			recipe.Winner, err = selector.Select(result, sources, s)
 			if err != nil {
 				panic(err)
 			}
+		} else if sampler.Temperature > 0 {
+			recipe.Sampled = &spotifaux.Sampler{Temperature: sampler.Temperature, Seed: sampler.Seed + int64(v)}
+			recipe.Winner = recipe.Sampled.Winners(result)
+		} else {
+			recipe.Winner = result.Winners()
+		}
 
-			subs := 0
-			for w := 0; w < len(winners); w++ {
-				if (winners[w] == spotifaux.Winner{}) || fileWinners[w].MinDist < winners[w].MinDist {
-					winners[w] = fileWinners[w]
-					subs++
-				}
-			}
+		// the limits on reuse span every query shingle, so are enforced once the files are merged
+		recipe.Winner = diversity.Apply(recipe.Winner, result)
+		recipes[v] = recipe
+		units = append(units, recipe.Winner...)
+	}
+
+	// the fallback corpus is only matched for the shingles some recipe has no unit for
+	var fallback *spotifaux.MatchResult
+	if fallbackSources != nil {
+		fallback, err = s.MatchFallback(ctx, matcher, fallbackSources, units, printProgress("matching fallback"))
+		if err != nil {
+			panic(err)
+		}
+		if fallback != nil {
+			matched += len(fallbackSources)
+		}
+	}
 
-			writeRecipe(winners) // overwrite recipe each time
+	var recipeFileNames []string
+	for v, recipe := range recipes {
+		recipe.Winner = s.FallBack(recipe.Winner, fallback)
 
-			totalTime += time.Since(start)
-			wavCount++
-			estDone := time.Now().Add(totalTime / time.Duration(wavCount) * time.Duration((len(files)-i)/3))
+		recipeFileName := variationName("recipe", ".json", v, variations)
+		writeRecipe(recipeFileName, recipe)
+		recipeFileNames = append(recipeFileNames, recipeFileName)
+	}
 
-			fmt.Printf("  %d of %d %s subs %d/%d estDone %s\n", i, len(files), fi.Name(), subs, x,
-				estDone.Format("15:04:05"))
+	fmt.Printf("  matched %d shingles against %d files in %s\n", len(result.Shingles), matched,
+		time.Since(start).Round(time.Second))
+	if result.Pruned > 0 {
+		fmt.Printf("  pruned %d of %d positions (%.1f%%)\n", result.Pruned, result.Pairs,
+			100*float64(result.Pruned)/float64(result.Pairs))
+	}
+	return recipeFileNames
+}
+
+// readQuery reads every frame of a query dat
+func readQuery(datFileName string, cqtN int) [][]float64 {
+	source, err := spotifaux.NewDatReader(datFileName, cqtN)
+	if err != nil {
+		panic(err)
+	}
+
+	frames := make([][]float64, source.Frames)
+	for d := range frames {
+		frames[d], err = source.Dat()
+		if err != nil {
+			panic(err)
 		}
 	}
+
+	err = source.Close()
+	if err != nil {
+		panic(err)
+	}
+	return frames
 }
 
-func writeRecipe(winners []spotifaux.Winner) {
-	recipe, err := os.Create("recipe.json")
+// transposedQueries extracts the source shifted down by each transposition in [-semitones, semitones], for
+// matching the corpus shifted up by as much
+func transposedQueries(ctx context.Context, sourceFileName string, semitones int) map[int][][]float64 {
+	if semitones <= 0 {
+		return nil
+	}
+	queries := map[int][][]float64{}
+	for k := -semitones; k <= semitones; k++ {
+		if k == 0 {
+			continue
+		}
+		e := spotifaux.NewFeatureExtractor(spotifaux.SAMPLE_RATE)
+		e.Transpose = -k
+		queries[k] = readQuery(audioDat(ctx, e, openCache(e), sourceFileName), e.CqtN)
+	}
+	return queries
+}
+
+// variationName numbers the files of variation v if there is more than one
+func variationName(base, ext string, v, variations int) string {
+	if variations == 1 {
+		return base + ext
+	}
+	return fmt.Sprintf("%s-%d%s", base, v+1, ext)
+}
+
+func writeRecipe(fileName string, r spotifaux.Recipe) {
+	recipe, err := os.Create(fileName)
 	if err != nil {
 		panic(err)
 	}
 	defer recipe.Close()
 
-	_, err = recipe.WriteString("{\"recipe\":[\n")
+	sampled := ""
+	if r.Sampled != nil {
+		sampled = fmt.Sprintf("\"sampled\":{\"temperature\":%g,\"seed\":%d},", r.Sampled.Temperature, r.Sampled.Seed)
+	}
+	_, err = recipe.WriteString(fmt.Sprintf("{\"distance\":%s,\"hop\":%d,%s\n\"recipe\":[\n", jsonString(r.Distance), r.Hop,
+		sampled))
 	if err != nil {
 		panic(err)
 	}
 
-	for w, winner := range winners {
+	for w, winner := range r.Winner {
 		maybeComma := ","
-		if w == len(winners)-1 {
+		if w == len(r.Winner)-1 {
 			maybeComma = ""
 		}
 
-		w := fmt.Sprintf("{\"file\":\"%s\",\"winner\":%d}%s\n", winner.File, winner.Winner, maybeComma)
+		length := ""
+		if winner.Span > 0 {
+			length = fmt.Sprintf(",\"span\":%d", winner.Span)
+		}
+		if winner.Length > 0 {
+			length += fmt.Sprintf(",\"length\":%d", winner.Length)
+		}
+		transform := ""
+		if winner.Transpose != 0 {
+			transform = fmt.Sprintf(",\"transpose\":%d", winner.Transpose)
+		}
+		if winner.Reversed {
+			transform += ",\"reversed\":true"
+		}
+		if winner.Gain != 0 {
+			transform += fmt.Sprintf(",\"gain\":%g", winner.Gain)
+		}
+		fallback := ""
+		if winner.Fallback != "" {
+			fallback = fmt.Sprintf(",\"fallback\":%s", jsonString(winner.Fallback))
+		}
+		w := fmt.Sprintf("{\"query\":%d,\"file\":%s,\"winner\":%d%s%s%s}%s\n", winner.Query, jsonString(winner.File),
+			winner.Winner, length, transform, fallback, maybeComma)
 		_, err = recipe.WriteString(w)
 		if err != nil {
 			panic(err)
@@ -220,37 +653,86 @@ func writeRecipe(winners []spotifaux.Winner) {
 	}
 }
 
-func recipeToOutput(sourceWavFileName string, s *spotifaux.SoundSpotter) {
+// jsonString quotes s as a JSON string, as file names from corpora and archives may hold any character
+func jsonString(s string) string {
+	b, err := json.Marshal(s)
+	if err != nil {
+		panic(err)
+	}
+	return string(b)
+}
 
-	sf, err := spotifaux.NewSoundFile(sourceWavFileName)
+func recipeToOutput(ctx context.Context, sourceFileName, recipeFileName, outFileName string, s *spotifaux.SoundSpotter,
+	corpus, fallbackCorpus *spotifaux.Corpus) {
+
+	// the source is read once, as units are not in time order once the recipe overlaps or reorders them
+	sourceFS := os.DirFS(filepath.Dir(sourceFileName))
+	a, err := spotifaux.OpenAudio(sourceFS, filepath.Base(sourceFileName))
+	if err != nil {
+		panic(err)
+	}
+	sourceBuf, err := a.ReadAll()
+	a.Close()
 	if err != nil {
 		panic(err)
 	}
-	defer sf.Close()
 
-	recipe := readRecipe()
+	recipe := readRecipe(recipeFileName)
+	if recipe.Hop == 0 {
+		for i := range recipe.Winner {
+			recipe.Winner[i].Query = i * s.ShingleSize
+		}
+	}
+	spans := make([]int, len(recipe.Winner))
+	overlapping := false
+	for i, winner := range recipe.Winner {
+		spans[i] = winner.Span
+		if spans[i] == 0 {
+			spans[i] = s.ShingleSize
+		}
+		if i > 0 && recipe.Winner[i-1].Query+spans[i-1] > winner.Query {
+			overlapping = true
+		}
+	}
 
-	wavWriter := spotifaux.NewWavWriter("out.wav")
-	defer wavWriter.Close()
+	corpusReader, sourceReader := spotifaux.NewAudioReader(corpus), spotifaux.NewAudioReader(sourceFS)
+	var fallbackReader *spotifaux.AudioReader
+	if fallbackCorpus != nil {
+		fallbackReader = spotifaux.NewAudioReader(fallbackCorpus)
+	}
 
-	for _, winner := range recipe.Winner {
+	wavWriter := spotifaux.NewWavWriter(outFileName)
+	defer wavWriter.Close()
 
-		inPower, err := getInPower(sf, spotifaux.Hop*s.ShingleSize)
-		if err != nil {
+	ola := spotifaux.NewOverlapAdd(spotifaux.Hop*s.ShingleSize, overlapping)
+	for i, winner := range recipe.Winner {
+		if err := ctx.Err(); err != nil {
 			panic(err)
 		}
 
-		output, err := s.Output(winner.File, winner.Winner, inPower)
+		query := winner.Query
+		inPower := getInPower(sourceBuf, query*spotifaux.Hop, spotifaux.Hop*spans[i])
+
+		reader := corpusReader
+		switch winner.Fallback {
+		case spotifaux.FallbackPassthrough.String():
+			reader, winner.File = sourceReader, filepath.Base(sourceFileName)
+		case spotifaux.FallbackCorpus.String():
+			reader = fallbackReader
+		}
+
+		output, err := s.Output(reader, winner, inPower)
 		if err != nil {
 			panic(err)
 		}
 
-		wavWriter.WriteItems(output)
+		wavWriter.WriteItems(ola.Add(query*spotifaux.Hop, output))
 	}
+	wavWriter.WriteItems(ola.Flush())
 }
 
-func readRecipe() spotifaux.Recipe {
-	recipeFile, err := os.Open("recipe.json")
+func readRecipe(fileName string) spotifaux.Recipe {
+	recipeFile, err := os.Open(fileName)
 	if err != nil {
 		fmt.Println(err)
 	}
@@ -269,19 +751,18 @@ func readRecipe() spotifaux.Recipe {
 	return recipe
 }
 
-func getInPower(sf *spotifaux.SoundFile, bufLength int) (float64, error) {
-
-	buf := make([]float64, bufLength)
-	read, err := sf.ReadFrames(buf)
-	if err != nil {
-		return 0, err
+// getInPower is the mean power of samples [at, at+bufLength), the part past the end counting as silence
+func getInPower(samples []float64, at, bufLength int) float64 {
+	end := at + bufLength
+	if end > len(samples) {
+		end = len(samples)
 	}
 
 	inPower := 0.0
-	for nn := 0; nn < int(read); nn++ {
-		inPower += math.Pow(buf[nn], 2)
+	for nn := at; nn < end; nn++ {
+		inPower += math.Pow(samples[nn], 2)
 	}
 	inPower /= float64(bufLength)
 
-	return inPower, nil
+	return inPower
 }
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"runtime"
+	"spotifaux"
+	"text/tabwriter"
+)
+
+const searchUsage = `usage: runner search [flags] clip (featureFile | corpusDir)...
+  finds the places in the corpora most like an audio clip`
+
+func searchCommand(args []string) {
+	flags := flag.NewFlagSet("search", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), searchUsage)
+		flags.PrintDefaults()
+	}
+	searcher := &spotifaux.Searcher{}
+	flags.IntVar(&searcher.Hits, "n", 10, "hits to return")
+	flags.Float64Var(&searcher.Overlap, "overlap", 0, "fraction of the shorter of two hits of a file they may share")
+	format := flags.String("format", "table", "table or json")
+	matcher := &spotifaux.CorpusMatcher{}
+	flags.IntVar(&matcher.Workers, "workers", runtime.NumCPU(), "database files matched concurrently")
+	backend := flags.String("backend", "auto", "matcher backend: auto, direct, fft or quantized")
+	stretch := flags.Float64("stretch", 1, "also find the clip up to this ratio slower or faster, 1 for its own speed")
+	timeout := flags.Duration("timeout", 0, "give up after this long, 0 for no limit")
+	addCorpusFlags(flags)
+	addCacheFlags(flags)
+	err := flags.Parse(args)
+	if err != nil {
+		panic(err)
+	}
+	if flags.NArg() < 2 || (*format != "table" && *format != "json") {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	ctx, cancel := interruptible(*timeout)
+	defer cancel()
+
+	e := spotifaux.NewFeatureExtractor(spotifaux.SAMPLE_RATE)
+	clip := flags.Arg(0)
+	clipDatFileName := audioDat(ctx, e, openCache(e), clip)
+	s := &spotifaux.SoundSpotter{
+		ChosenFeatures: chosenFeatures,
+		CqtN:           e.CqtN,
+		InShingles:     readQuery(clipDatFileName, e.CqtN),
+		Backend:        matchBackend(*backend),
+		MaxStretch:     *stretch,
+	}
+	sources := featureSources(ctx, e, flags.Args()[1:])
+
+	hits, err := searcher.Search(ctx, matcher, sources, s, printProgress("searching"))
+	if err != nil {
+		panic(err)
+	}
+
+	if *format == "json" {
+		if hits == nil {
+			hits = []spotifaux.Hit{}
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(hits)
+		if err != nil {
+			panic(err)
+		}
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "rank\tdistance\tstart\tend\tfile")
+	for i, hit := range hits {
+		fmt.Fprintf(w, "%d\t%.4f\t%.2f\t%.2f\t%s\n", i+1, hit.Distance, hit.Start, hit.End, hit.File)
+	}
+	err = w.Flush()
+	if err != nil {
+		panic(err)
+	}
+}
@@ -0,0 +1,79 @@
+package spotifaux
+
+import (
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Corpus is a tree of audio files, possibly inside zip and tar(.gz) archives.
+// File names are slash separated paths relative to the root, with archives
+// appearing as directories, e.g. "packs/drums.zip/kick/01.wav".
+type Corpus struct {
+	fs.FS
+	Root    string   // the absolute path of the directory opened by OpenCorpus, empty for other file systems
+	Include []string // globs a file must match (all files if empty)
+	Exclude []string // globs that drop a file, also prunes directories and archives
+}
+
+func NewCorpus(fsys fs.FS) *Corpus {
+	return &Corpus{FS: newArchiveFS(fsys)}
+}
+
+func OpenCorpus(dirname string) *Corpus {
+	c := NewCorpus(os.DirFS(dirname))
+	c.Root, _ = filepath.Abs(dirname) // left empty if the working directory is gone
+	return c
+}
+
+// Files walks the corpus recursively and returns the audio files selected by Include and Exclude
+func (c *Corpus) Files() ([]string, error) {
+	var files []string
+	err := c.walk(".", &files)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+func (c *Corpus) walk(root string, files *[]string) error {
+	return fs.WalkDir(c.FS, root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if p != root && matchAny(c.Exclude, p) {
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() {
+			return nil
+		}
+		if IsArchive(p) && p != root {
+			return c.walk(p, files)
+		}
+		if IsAudioFile(p) && (len(c.Include) == 0 || matchAny(c.Include, p)) {
+			*files = append(*files, p)
+		}
+		return nil
+	})
+}
+
+// matchAny matches globs without a slash against the base name and the others against the whole path
+func matchAny(globs []string, p string) bool {
+	for _, glob := range globs {
+		name := p
+		if !strings.Contains(glob, "/") {
+			name = path.Base(p)
+		}
+		if ok, _ := path.Match(glob, name); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,137 @@
+package spotifaux
+
+import (
+	"context"
+	"runtime"
+	"sync"
+)
+
+// CorpusMatcher matches the query against many database files concurrently
+type CorpusMatcher struct {
+	Workers int // goroutines, runtime.NumCPU() if 0
+	// ChunkFrames splits database files into ranges of this many positions, 0 for whole files. It is
+	// rounded up to a multiple of 1024, the positions correlated at a time, so that splitting does
+	// not change any sums.
+	ChunkFrames int
+}
+
+type matchJob struct {
+	source   FeatureSource
+	from, to int
+}
+
+// Match returns the merged candidates of all sources. Jobs are reduced in source and range order,
+// which together with the total order on candidates makes the result independent of scheduling
+// and identical to matching the sources one after another.
+func (m *CorpusMatcher) Match(sources []FeatureSource, s *SoundSpotter) (*MatchResult, error) {
+	return m.MatchContext(context.Background(), sources, s, nil)
+}
+
+// MatchContext is Match stopping with the error of ctx once it is cancelled, and reporting its progress
+// to progress if it is not nil
+func (m *CorpusMatcher) MatchContext(ctx context.Context, sources []FeatureSource, s *SoundSpotter,
+	progress ProgressFunc) (*MatchResult, error) {
+
+	jobs, err := m.jobs(sources, s)
+	if err != nil {
+		return nil, err
+	}
+	total := 0
+	for _, job := range jobs {
+		total += job.to - job.from
+	}
+	t := newTracker(ctx, progress, total*len(s.transforms()), len(sources), queryShingles(s))
+
+	workers := m.Workers
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+
+	results := make([]*MatchResult, len(jobs))
+	errs := make([]error, len(jobs))
+	done := make([]chan struct{}, len(jobs))
+	for i := range done {
+		done[i] = make(chan struct{})
+	}
+
+	var failed sync.Once
+	stop := make(chan struct{})
+	next := make(chan int)
+	go func() {
+		defer close(next)
+		for i := range jobs {
+			select {
+			case next <- i:
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				job := jobs[i]
+				results[i], errs[i] = matchRange(t, job.source.Name, job.source.DatFileName, s, job.from, job.to)
+				if errs[i] != nil {
+					failed.Do(func() { close(stop) })
+				}
+				close(done[i])
+			}
+		}()
+	}
+
+	// reduce in job order as results arrive, releasing each one once merged
+	result := NewMatchResult(queryShingles(s), s)
+	for i := range jobs {
+		select {
+		case <-done[i]:
+			if errs[i] == nil {
+				result.Merge(results[i])
+				results[i] = nil
+				if i == len(jobs)-1 || jobs[i+1].source != jobs[i].source {
+					t.fileDone()
+				}
+				continue
+			}
+		case <-stop:
+		}
+		wg.Wait()
+		for _, err := range errs {
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	wg.Wait()
+	return result, nil
+}
+
+func (m *CorpusMatcher) jobs(sources []FeatureSource, s *SoundSpotter) ([]matchJob, error) {
+	frames, err := sourceFrames(sources, s.CqtN)
+	if err != nil {
+		return nil, err
+	}
+
+	// ranges start on matchBlock boundaries, so that splitting does not change any sums
+	chunk := (m.ChunkFrames + matchBlock - 1) / matchBlock * matchBlock
+
+	var jobs []matchJob
+	for i, source := range sources {
+		if m.ChunkFrames <= 0 {
+			chunk = frames[i]
+		}
+		for from := 0; from < frames[i]; from += chunk {
+			to := from + chunk
+			if to > frames[i] {
+				to = frames[i]
+			}
+			jobs = append(jobs, matchJob{source, from, to})
+		}
+	}
+	return jobs, nil
+}
@@ -0,0 +1,132 @@
+package spotifaux_test
+
+import (
+	"encoding/binary"
+	"github.com/stretchr/testify/assert"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"spotifaux"
+	"testing"
+)
+
+const testCqtN = 24
+
+func writeTestDat(t testing.TB, fileName string, frames [][]uint8) {
+	b := make([]byte, 8)
+	binary.LittleEndian.PutUint64(b, uint64(len(frames)))
+	for _, frame := range frames {
+		b = append(b, frame...)
+	}
+	err := os.WriteFile(fileName, b, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func randomFrames(r *rand.Rand, n int) [][]uint8 {
+	frames := make([][]uint8, n)
+	for i := range frames {
+		frames[i] = make([]uint8, testCqtN)
+		r.Read(frames[i])
+	}
+	return frames
+}
+
+// quantizeFrames returns the stored bytes that features were read from, to plant query frames in a
+// database
+func quantizeFrames(features [][]float64) [][]uint8 {
+	frames := make([][]uint8, len(features))
+	for i, frame := range features {
+		frames[i] = make([]uint8, len(frame))
+		for j, v := range frame {
+			frames[i][j] = uint8(math.Round(v*255 + 128))
+		}
+	}
+	return frames
+}
+
+// testCorpus writes random dat files, the last a copy of the first so that every distance ties
+func testCorpus(t testing.TB, r *rand.Rand, lengths ...int) []spotifaux.FeatureSource {
+	dir := t.TempDir()
+	var sources []spotifaux.FeatureSource
+	var first [][]uint8
+	for i, n := range lengths {
+		frames := randomFrames(r, n)
+		if i == 0 {
+			first = frames
+		} else if i == len(lengths)-1 {
+			frames = first
+		}
+		name := string(rune('a' + i))
+		datFileName := filepath.Join(dir, name+".dat")
+		writeTestDat(t, datFileName, frames)
+		sources = append(sources, spotifaux.FeatureSource{Name: name, DatFileName: datFileName})
+	}
+	return sources
+}
+
+func testSpotter(r *rand.Rand, queryFrames int) *spotifaux.SoundSpotter {
+	s := &spotifaux.SoundSpotter{
+		ChosenFeatures: []int{1, 2, 3, 5, 7},
+		CqtN:           testCqtN,
+		ShingleSize:    4,
+		TopK:           3,
+	}
+	for _, frame := range randomFrames(r, queryFrames) {
+		features := make([]float64, testCqtN)
+		for i, b := range frame {
+			features[i] = (float64(b) - 128) / 255
+		}
+		s.InShingles = append(s.InShingles, features)
+	}
+	return s
+}
+
+func Test_corpusMatcherMatchesSerial(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	sources := testCorpus(t, r, 50, 3, 37, 50)
+	s := testSpotter(r, 24)
+
+	serial := spotifaux.NewMatchResult(6, s)
+	for _, source := range sources {
+		result, err := spotifaux.Match(source.Name, source.DatFileName, s)
+		assert.NoError(t, err)
+		serial.Merge(result)
+	}
+
+	for _, m := range []*spotifaux.CorpusMatcher{{Workers: 1}, {Workers: 4}, {Workers: 3, ChunkFrames: 7}} {
+		result, err := m.Match(sources, s)
+		assert.NoError(t, err)
+		assert.Equal(t, serial.Winners(), result.Winners())
+		for i := range serial.Shingles {
+			assert.Equal(t, serial.Shingles[i].Winners(), result.Shingles[i].Winners())
+		}
+	}
+}
+
+func Test_corpusMatcherChunksMatchSerial(t *testing.T) {
+	r := rand.New(rand.NewSource(33))
+	sources := testCorpus(t, r, 2500, 3, 1500, 2500)
+	s := testSpotter(r, 24)
+
+	serial := spotifaux.NewMatchResult(6, s)
+	for _, source := range sources {
+		result, err := spotifaux.Match(source.Name, source.DatFileName, s)
+		assert.NoError(t, err)
+		serial.Merge(result)
+	}
+
+	// each is rounded to 1024, which splits the long files into three ranges
+	for _, m := range []*spotifaux.CorpusMatcher{{Workers: 3, ChunkFrames: 1}, {Workers: 3, ChunkFrames: 1000},
+		{Workers: 2, ChunkFrames: 1024}} {
+
+		result, err := m.Match(sources, s)
+		assert.NoError(t, err)
+		assert.Equal(t, serial.Winners(), result.Winners())
+		for i := range serial.Shingles {
+			assert.Equal(t, serial.Shingles[i].Winners(), result.Shingles[i].Winners())
+		}
+	}
+}
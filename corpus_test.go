@@ -0,0 +1,177 @@
+package spotifaux_test
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"spotifaux"
+	"testing"
+)
+
+// testZip returns a zip archive of files, keyed by slash separated path
+func testZip(t testing.TB, files map[string][]byte) []byte {
+	var b bytes.Buffer
+	zw := zip.NewWriter(&b)
+	for name, data := range files {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(data)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+// testTar returns a tar archive of files, gzipped if compress is set
+func testTar(t testing.TB, files map[string][]byte, compress bool) []byte {
+	var b bytes.Buffer
+	var w io.Writer = &b
+	var zw *gzip.Writer
+	if compress {
+		zw = gzip.NewWriter(&b)
+		w = zw
+	}
+	tw := tar.NewWriter(w)
+	for name, data := range files {
+		err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(data)), Typeflag: tar.TypeReg})
+		if err != nil {
+			t.Fatal(err)
+		}
+		tw.Write(data)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if zw != nil {
+		if err := zw.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return b.Bytes()
+}
+
+func writeTestFiles(t testing.TB, dir string, files map[string][]byte) {
+	for name, data := range files {
+		fileName := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(fileName), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(fileName, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func Test_corpusEnumeratesArchives(t *testing.T) {
+	dir := t.TempDir()
+	ramp := make([]float64, 1000)
+	for i := range ramp {
+		ramp[i] = float64(i) / 2000
+	}
+	writeTestWav(t, filepath.Join(dir, "ramp.wav"), ramp, spotifaux.SAMPLE_RATE)
+	wavBytes, err := os.ReadFile(filepath.Join(dir, "ramp.wav"))
+	assert.NoError(t, err)
+	assert.NoError(t, os.Remove(filepath.Join(dir, "ramp.wav")))
+
+	writeTestFiles(t, dir, map[string][]byte{
+		"a/kick.wav":  []byte("kick"),
+		"a/snare.WAV": []byte("snare"),
+		"notes.txt":   []byte("notes"),
+		"skip/x.wav":  []byte("x"),
+		"packs/drums.zip": testZip(t, map[string][]byte{
+			"kick/01.wav": []byte("01"),
+			"readme.txt":  []byte("readme"),
+			"inner.tar":   testTar(t, map[string][]byte{"deep/deep.wav": []byte("deep")}, false),
+		}),
+		"packs/loops.tar.gz": testTar(t, map[string][]byte{
+			"loops/120/a.wav": wavBytes,
+			"loops/b.ogg":     []byte("b"),
+			"loops/c.zip":     testZip(t, map[string][]byte{"c.flac": []byte("c")}),
+		}, true),
+	})
+
+	c := spotifaux.OpenCorpus(dir)
+	files, err := c.Files()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		"a/kick.wav",
+		"a/snare.WAV",
+		"packs/drums.zip/inner.tar/deep/deep.wav",
+		"packs/drums.zip/kick/01.wav",
+		"packs/loops.tar.gz/loops/120/a.wav",
+		"packs/loops.tar.gz/loops/b.ogg",
+		"packs/loops.tar.gz/loops/c.zip/c.flac",
+		"skip/x.wav",
+	}, files)
+
+	for name, want := range map[string]string{
+		"packs/drums.zip/inner.tar/deep/deep.wav": "deep",
+		"packs/drums.zip/kick/01.wav":             "01",
+		"packs/loops.tar.gz/loops/b.ogg":          "b",
+		"packs/loops.tar.gz/loops/c.zip/c.flac":   "c",
+	} {
+		b, err := fs.ReadFile(c, name)
+		assert.NoError(t, err, name)
+		assert.Equal(t, want, string(b), name)
+	}
+	_, err = c.Open("packs/loops.tar.gz/loops/missing.wav")
+	assert.True(t, errors.Is(err, fs.ErrNotExist))
+
+	a, err := spotifaux.OpenAudio(c, "packs/loops.tar.gz/loops/120/a.wav")
+	assert.NoError(t, err)
+	samples, err := a.ReadAll()
+	assert.NoError(t, err)
+	assert.NoError(t, a.Close())
+	assert.InDeltaSlice(t, ramp, samples, 1e-3)
+
+	c.Include = []string{"*.wav", "packs/loops.tar.gz/loops/*.ogg"}
+	c.Exclude = []string{"skip", "inner.tar"}
+	files, err = c.Files()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		"a/kick.wav",
+		"packs/drums.zip/kick/01.wav",
+		"packs/loops.tar.gz/loops/120/a.wav",
+		"packs/loops.tar.gz/loops/b.ogg",
+	}, files)
+}
+
+func Test_corpusReadsTarMembersInAnyOrder(t *testing.T) {
+	dir := t.TempDir()
+	members := map[string][]byte{}
+	var names []string
+	for i := 0; i < 20; i++ {
+		name := fmt.Sprintf("loops/%02d.wav", i)
+		members[name] = bytes.Repeat([]byte{byte(i)}, 1000+i)
+		names = append(names, name)
+	}
+	writeTestFiles(t, dir, map[string][]byte{"loops.tgz": testTar(t, members, true)})
+
+	c := spotifaux.OpenCorpus(dir)
+	order := append([]string{}, names...)
+	for i := len(names) - 1; i >= 0; i-- {
+		order = append(order, names[i])
+	}
+	order = append(order, names[3], names[17], names[3], names[0])
+	for _, name := range order {
+		f, err := c.Open("loops.tgz/" + name)
+		assert.NoError(t, err, name)
+		_, seekable := f.(io.Seeker)
+		assert.True(t, seekable, name)
+		b, err := io.ReadAll(f)
+		assert.NoError(t, err, name)
+		assert.NoError(t, f.Close())
+		assert.Equal(t, members[name], b, name)
+	}
+}
@@ -1,53 +1,173 @@
 package spotifaux
 
 import (
+	"bufio"
+	"bytes"
 	"encoding/binary"
+	"fmt"
+	"io"
 	"os"
 )
 
 type datReader struct {
-	f      *os.File
-	Frames int
-	cqtN   int
+	f          *os.File
+	r          *bufio.Reader
+	name       string
+	Frames     int
+	Width      int    // features per frame, cqtN for dat features, declared by the shape of a .npy
+	dtype      string // "" for quantized dat features, else the dtype of an imported .npy
+	dataOffset int64  // size of the header
 }
 
+// NewDatReader opens features extracted by FeatureExtractor, with cqtN features per frame, or a 2-d
+// float32/float64 .npy array of (frames, features) computed elsewhere, of any number of features
 func NewDatReader(fileName string, cqtN int) (*datReader, error) {
 	r := &datReader{
-		cqtN: cqtN,
+		name:  fileName,
+		Width: cqtN,
 	}
 
 	f, err := os.Open(fileName)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 	r.f = f
+	r.r = bufio.NewReader(f)
 
-	fb := make([]byte, 8)
-	_, err = r.f.Read(fb)
+	magic, err := r.r.Peek(len(npyMagic) - 2)
+	if err == nil && bytes.Equal(magic, npyMagic[:len(magic)]) {
+		err = r.readNpyHeader(fileName)
+	} else {
+		fb := make([]byte, 8)
+		_, err = io.ReadFull(r.r, fb)
+		r.Frames = int(binary.LittleEndian.Uint64(fb))
+	}
 	if err != nil {
+		f.Close()
 		return nil, err
 	}
-	r.Frames = int(binary.LittleEndian.Uint64(fb))
+
+	offset, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	r.dataOffset = offset - int64(r.r.Buffered())
 
 	return r, nil
 }
 
-func (r *datReader) Dat() ([]float64, error) {
-	b := make([]uint8, r.cqtN)
-	_, err := r.f.Read(b)
+func (r *datReader) readNpyHeader(fileName string) error {
+	descr, shape, err := readNpyHeader(r.r)
 	if err != nil {
-		return nil, err
+		return fmt.Errorf("%s: %v", fileName, err)
+	}
+	if descr != "<f4" && descr != "<f8" {
+		return fmt.Errorf("%s: dtype %s, expected <f4 or <f8", fileName, descr)
 	}
+	if len(shape) != 2 || shape[1] < 1 {
+		return fmt.Errorf("%s: shape %v, expected (frames, features)", fileName, shape)
+	}
+	r.dtype = descr
+	r.Frames, r.Width = shape[0], shape[1]
+	return nil
+}
 
-	features := make([]float64, r.cqtN)
+// checkChosen returns an error if any of the chosen features is not among the features of each frame
+func (r *datReader) checkChosen(chosen []int) error {
+	return checkChosen(chosen, r.name, r.Width)
+}
 
-	for i := 0; i < r.cqtN; i++ {
-		features[i] = (float64(b[i]) - 128.0) / 255.0
+// checkChosen returns an error if any of the chosen features is not among the width features of each
+// frame of name
+func checkChosen(chosen []int, name string, width int) error {
+	for _, qp := range chosen {
+		if qp < 0 || qp >= width {
+			return fmt.Errorf("%s has %d features per frame, so no feature %d to choose", name, width, qp)
+		}
+	}
+	return nil
+}
+
+// FrameSize is the number of bytes per frame
+func (r *datReader) FrameSize() int {
+	switch r.dtype {
+	case "<f4":
+		return 4 * r.Width
+	case "<f8":
+		return 8 * r.Width
+	default:
+		return r.Width
+	}
+}
+
+// Size is the file size implied by the header
+func (r *datReader) Size() int64 {
+	return r.dataOffset + int64(r.Frames)*int64(r.FrameSize())
+}
+
+// Seek positions the reader so that the next call to Dat returns frame
+func (r *datReader) Seek(frame int) error {
+	_, err := r.f.Seek(r.dataOffset+int64(frame)*int64(r.FrameSize()), io.SeekStart)
+	if err != nil {
+		return err
+	}
+	r.r.Reset(r.f)
+	return nil
+}
+
+func (r *datReader) Dat() ([]float64, error) {
+	features := make([]float64, r.Width)
+
+	switch r.dtype {
+	case "<f4":
+		b := make([]float32, r.Width)
+		err := binary.Read(r.r, binary.LittleEndian, b)
+		if err != nil {
+			return nil, err
+		}
+		for i := 0; i < r.Width; i++ {
+			features[i] = float64(b[i])
+		}
+
+	case "<f8":
+		err := binary.Read(r.r, binary.LittleEndian, features)
+		if err != nil {
+			return nil, err
+		}
+
+	default:
+		b := make([]uint8, r.Width)
+		_, err := io.ReadFull(r.r, b)
+		if err != nil {
+			return nil, err
+		}
+		for i := 0; i < r.Width; i++ {
+			features[i] = dequantize(b[i])
+		}
 	}
 
 	return features, nil
 }
 
+// Quantized reports whether the features are stored as bytes, which ReadRaw returns as they are
+func (r *datReader) Quantized() bool {
+	return r.dtype == ""
+}
+
+// ReadRaw reads the next len(buf)/cqtN quantized frames into buf without converting them
+func (r *datReader) ReadRaw(buf []byte) error {
+	if !r.Quantized() {
+		return fmt.Errorf("features of dtype %s are not quantized", r.dtype)
+	}
+	_, err := io.ReadFull(r.r, buf)
+	return err
+}
+
 func (r *datReader) Close() error {
 	return r.f.Close()
 }
+
+func dequantize(b uint8) float64 {
+	return (float64(b) - 128.0) / 255.0
+}
@@ -0,0 +1,47 @@
+package spotifaux
+
+import (
+	"fmt"
+	"github.com/faiface/beep"
+	"github.com/faiface/beep/flac"
+	"github.com/faiface/beep/mp3"
+	"github.com/faiface/beep/vorbis"
+	"github.com/faiface/beep/wav"
+	"io"
+	"path/filepath"
+	"strings"
+)
+
+// Decoder turns an encoded audio file into a beep stream at its native sample rate.
+// The returned StreamSeekCloser owns rc and closes it.
+type Decoder func(rc io.ReadCloser) (beep.StreamSeekCloser, beep.Format, error)
+
+var decoders = map[string]Decoder{
+	".flac": func(rc io.ReadCloser) (beep.StreamSeekCloser, beep.Format, error) {
+		return flac.Decode(rc)
+	},
+	".mp3": mp3.Decode,
+	".ogg": vorbis.Decode,
+	".wav": func(rc io.ReadCloser) (beep.StreamSeekCloser, beep.Format, error) {
+		return wav.Decode(rc)
+	},
+}
+
+// RegisterDecoder adds or replaces the decoder used for files with extension ext (e.g. ".aiff")
+func RegisterDecoder(ext string, d Decoder) {
+	decoders[strings.ToLower(ext)] = d
+}
+
+// IsAudioFile reports whether a decoder is registered for fileName's extension
+func IsAudioFile(fileName string) bool {
+	_, ok := decoders[strings.ToLower(filepath.Ext(fileName))]
+	return ok
+}
+
+func decoderFor(fileName string) (Decoder, error) {
+	d, ok := decoders[strings.ToLower(filepath.Ext(fileName))]
+	if !ok {
+		return nil, fmt.Errorf("no decoder registered for %s", fileName)
+	}
+	return d, nil
+}
@@ -0,0 +1,399 @@
+package spotifaux
+
+import (
+	"fmt"
+	"math"
+)
+
+// Shingle is a sequence of frames of the chosen features and its mean frame power in dB
+type Shingle struct {
+	Frames [][]float64
+	Power  float64
+}
+
+// Distance measures how far a database shingle is from a query shingle. Near the end of a file the
+// database shingle has fewer frames than the query, and the missing frames count as zeros.
+type Distance interface {
+	Name() string // identifies the distance in recipe metadata
+	Distance(q, db Shingle) float64
+}
+
+// normDistance is a Distance that depends only on the cross term of the two shingles and their
+// norms, and decreases as the cross term grows. Match computes these with any backend, and bounds on
+// the cross term bound the distance for pruning.
+type normDistance interface {
+	Distance
+	fromNorms(DD, qN, dbN float64) float64
+}
+
+// frameTransform maps each frame of chosen features before a normDistance is applied
+type frameTransform interface {
+	transform(frame []float64) []float64
+}
+
+// norms returns the cross term of two shingles and their norms
+func norms(q, db [][]float64) (DD, qN, dbN float64) {
+	for muxi, frame := range q {
+		qN += dot(frame, frame)
+		if muxi < len(db) {
+			DD += dot(frame, db[muxi])
+			dbN += dot(db[muxi], db[muxi])
+		}
+	}
+	return DD, math.Sqrt(qN), math.Sqrt(dbN)
+}
+
+func normDistanceOf(d normDistance, q, db Shingle) float64 {
+	return d.fromNorms(norms(q.Frames, db.Frames))
+}
+
+// MatchedFilter is the normalized matched filter distance, |2 - 2 cos| of the angle between the shingles
+type MatchedFilter struct{}
+
+func (MatchedFilter) Name() string { return "matched-filter" }
+
+func (d MatchedFilter) Distance(q, db Shingle) float64 { return normDistanceOf(d, q, db) }
+
+func (MatchedFilter) fromNorms(DD, qN, dbN float64) float64 {
+	// The norm matched filter distance is the Euclidean distance between the vectors squared Euclidean distance
+	return math.Abs(2 - 2*DD/(qN*dbN))
+}
+
+// Cosine is one minus the cosine of the angle between the shingles
+type Cosine struct{}
+
+func (Cosine) Name() string { return "cosine" }
+
+func (d Cosine) Distance(q, db Shingle) float64 { return normDistanceOf(d, q, db) }
+
+func (Cosine) fromNorms(DD, qN, dbN float64) float64 {
+	return 1 - DD/(qN*dbN)
+}
+
+// SquaredEuclidean is the squared Euclidean distance between the shingles, so unlike the angular
+// distances it tells a quiet spectrum from a loud one of the same shape
+type SquaredEuclidean struct{}
+
+func (SquaredEuclidean) Name() string { return "squared-euclidean" }
+
+func (d SquaredEuclidean) Distance(q, db Shingle) float64 { return normDistanceOf(d, q, db) }
+
+func (SquaredEuclidean) fromNorms(DD, qN, dbN float64) float64 {
+	return math.Max(0, qN*qN+dbN*dbN-2*DD)
+}
+
+// Manhattan is the sum of absolute feature differences. It does not factor into cross terms and
+// norms, so Match compares every position in full.
+type Manhattan struct{}
+
+func (Manhattan) Name() string { return "manhattan" }
+
+func (Manhattan) Distance(q, db Shingle) float64 {
+	sum := 0.0
+	for muxi, frame := range q.Frames {
+		for i, v := range frame {
+			if muxi < len(db.Frames) {
+				v -= db.Frames[muxi][i]
+			}
+			sum += math.Abs(v)
+		}
+	}
+	return sum
+}
+
+// Mahalanobis is the squared Euclidean distance after whitening the frames with a covariance of the
+// chosen features, so correlated features are not counted twice and each is scaled by its spread
+type Mahalanobis struct {
+	chol [][]float64 // lower triangular Cholesky factor of the covariance
+}
+
+// NewMahalanobis whitens with cov, which is regularized by adding ridge times its mean variance to
+// the diagonal so that constant features do not make it singular
+func NewMahalanobis(cov [][]float64, ridge float64) (*Mahalanobis, error) {
+	n := len(cov)
+	meanVar := 0.0
+	for i := range cov {
+		meanVar += cov[i][i] / float64(n)
+	}
+
+	L := make([][]float64, n)
+	for i := range L {
+		L[i] = make([]float64, n)
+	}
+	for i := 0; i < n; i++ {
+		for j := 0; j <= i; j++ {
+			sum := cov[i][j]
+			if i == j {
+				sum += ridge * meanVar
+			}
+			for k := 0; k < j; k++ {
+				sum -= L[i][k] * L[j][k]
+			}
+			if i == j {
+				if sum <= 0 {
+					return nil, fmt.Errorf("covariance is not positive definite at feature %d", i)
+				}
+				L[i][i] = math.Sqrt(sum)
+			} else {
+				L[i][j] = sum / L[j][j]
+			}
+		}
+	}
+	return &Mahalanobis{chol: L}, nil
+}
+
+// CorpusCovariance is the covariance of the chosen features of s over every frame of the sources
+func CorpusCovariance(sources []FeatureSource, s *SoundSpotter) ([][]float64, error) {
+	n := len(s.ChosenFeatures)
+	mean := make([]float64, n)
+	cov := make([][]float64, n)
+	for i := range cov {
+		cov[i] = make([]float64, n)
+	}
+
+	// Welford's update, which stays accurate over long corpora
+	count := 0.0
+	delta := make([]float64, n)
+	for _, source := range sources {
+		dr, err := NewDatReader(source.DatFileName, s.CqtN)
+		if err != nil {
+			return nil, err
+		}
+		if err = dr.checkChosen(s.ChosenFeatures); err != nil {
+			dr.Close()
+			return nil, err
+		}
+		for j := 0; j < dr.Frames; j++ {
+			features, err := dr.Dat()
+			if err != nil {
+				dr.Close()
+				return nil, err
+			}
+			count++
+			for i, qp := range s.ChosenFeatures {
+				delta[i] = features[qp] - mean[i]
+				mean[i] += delta[i] / count
+			}
+			for i := range s.ChosenFeatures {
+				for k := 0; k <= i; k++ {
+					cov[i][k] += delta[i] * (features[s.ChosenFeatures[k]] - mean[k])
+				}
+			}
+		}
+		err = dr.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if count < 2 {
+		return nil, fmt.Errorf("%d frames are too few for a covariance", int(count))
+	}
+
+	for i := range cov {
+		for k := 0; k <= i; k++ {
+			cov[i][k] /= count - 1
+			cov[k][i] = cov[i][k]
+		}
+	}
+	return cov, nil
+}
+
+func (*Mahalanobis) Name() string { return "mahalanobis" }
+
+func (d *Mahalanobis) Distance(q, db Shingle) float64 {
+	return normDistanceOf(d, d.transformShingle(q), d.transformShingle(db))
+}
+
+func (*Mahalanobis) fromNorms(DD, qN, dbN float64) float64 {
+	return SquaredEuclidean{}.fromNorms(DD, qN, dbN)
+}
+
+// transform solves chol y = frame, so that |y|^2 is the Mahalanobis norm of frame
+func (d *Mahalanobis) transform(frame []float64) []float64 {
+	y := make([]float64, len(frame))
+	for i, row := range d.chol {
+		sum := frame[i]
+		for k := 0; k < i; k++ {
+			sum -= row[k] * y[k]
+		}
+		y[i] = sum / row[i]
+	}
+	return y
+}
+
+func (d *Mahalanobis) transformShingle(s Shingle) Shingle {
+	frames := make([][]float64, len(s.Frames))
+	for i, frame := range s.Frames {
+		frames[i] = d.transform(frame)
+	}
+	return Shingle{Frames: frames, Power: s.Power}
+}
+
+// PowerAware adds Weight per dB of loudness difference between the shingles to another distance
+type PowerAware struct {
+	Base   Distance
+	Weight float64
+}
+
+func (d PowerAware) Name() string {
+	return fmt.Sprintf("%s+power(%g)", d.Base.Name(), d.Weight)
+}
+
+func (d PowerAware) Distance(q, db Shingle) float64 {
+	return d.Base.Distance(q, db) + d.Weight*math.Abs(q.Power-db.Power)
+}
+
+// distance returns s.Distance, the matched filter if it is not set
+func (s *SoundSpotter) distance() Distance {
+	if s.Distance == nil {
+		return MatchedFilter{}
+	}
+	return s.Distance
+}
+
+// factorDistance splits d into a normDistance and the weight of a loudness term, ok being false if
+// d has to be computed in full at each position. The weight is returned either way.
+func factorDistance(d Distance) (nd normDistance, weight float64, ok bool) {
+	switch d := d.(type) {
+	case PowerAware:
+		nd, weight, ok = factorDistance(d.Base)
+		return nd, weight + d.Weight, ok
+	case *PowerAware:
+		return factorDistance(*d)
+	case normDistance:
+		return d, 0, true
+	}
+	return nil, 0, false
+}
+
+// scorer computes s.Distance for the query shingles against the positions of a database file
+type scorer struct {
+	d           Distance
+	nd          normDistance // nil if d does not factor
+	weight      float64      // of the loudness term
+	transform   frameTransform
+	chosen      []int
+	shingleSize int
+	qPower      []float64 // mean power of each query shingle
+	dbPower     []float64 // prefix sums of the database frame powers
+	gain        float64   // dB added to the database powers
+}
+
+func newScorer(s *SoundSpotter) (*scorer, error) {
+	sc := &scorer{d: s.distance(), chosen: s.ChosenFeatures, shingleSize: s.ShingleSize, gain: s.transform.Gain}
+	var ok bool
+	sc.nd, sc.weight, ok = factorDistance(sc.d)
+	if !ok {
+		sc.nd = nil
+	}
+	if sc.nd != nil {
+		sc.transform, _ = sc.nd.(frameTransform)
+	}
+
+	if sc.weight != 0 {
+		if len(s.InPowers) < len(s.InShingles) {
+			return nil, fmt.Errorf("%s distance needs the power of each query frame", sc.d.Name())
+		}
+		x := queryShingles(s)
+		sc.qPower = make([]float64, x)
+		for ins := range sc.qPower {
+			for muxi := 0; muxi < s.ShingleSize; muxi++ {
+				power := float64(silenceDB)
+				if i := ins*s.queryHop() + muxi; i < len(s.InPowers) {
+					power = s.InPowers[i]
+				}
+				sc.qPower[ins] += power / float64(s.ShingleSize)
+			}
+		}
+	}
+	return sc, nil
+}
+
+// load reads the frame powers of a database file if the distance needs them
+func (sc *scorer) load(datFileName string) error {
+	if sc.weight == 0 {
+		return nil
+	}
+	powers, err := ReadPowers(datFileName)
+	if err != nil {
+		return err
+	}
+	sc.dbPower = make([]float64, len(powers)+1)
+	for i, power := range powers {
+		sc.dbPower[i+1] = sc.dbPower[i] + power
+	}
+	return nil
+}
+
+// features returns the chosen features of a frame, transformed for the distance
+func (sc *scorer) features(frame []float64) []float64 {
+	v := chosenFeatures(frame, sc.chosen)
+	if sc.transform != nil {
+		v = sc.transform.transform(v)
+	}
+	return v
+}
+
+// power is the mean power of the database shingle at position p
+func (sc *scorer) power(p int) float64 {
+	return sc.powerOver(p, sc.shingleSize)
+}
+
+// powerOver is the mean power of the length database frames from position p, with the gain
+func (sc *scorer) powerOver(p, length int) float64 {
+	if sc.weight == 0 {
+		return 0
+	}
+	end := p + length
+	if end > len(sc.dbPower)-1 {
+		end = len(sc.dbPower) - 1
+	}
+	if end <= p {
+		return silenceDB + sc.gain
+	}
+	return (sc.dbPower[end]-sc.dbPower[p])/float64(end-p) + sc.gain
+}
+
+// score is the distance of query shingle ins from position p given their cross term and norms
+func (sc *scorer) score(ins, p int, DD, qN, dbN float64) float64 {
+	d := sc.nd.fromNorms(DD, qN, dbN)
+	if sc.weight != 0 {
+		d += sc.weight * math.Abs(sc.qPower[ins]-sc.power(p))
+	}
+	return d
+}
+
+// frameCost is the distance between a query frame and a database frame with norms qN and dbN, for
+// aligning shingles frame by frame. Where an angular distance is undefined, a silent frame counts as
+// orthogonal to a sounding frame and identical to another silent one.
+func (sc *scorer) frameCost(q, db []float64, qN, dbN float64) float64 {
+	if sc.nd == nil {
+		return sc.d.Distance(Shingle{Frames: [][]float64{q}}, Shingle{Frames: [][]float64{db}})
+	}
+	d := sc.nd.fromNorms(dot(q, db), qN, dbN)
+	if math.IsNaN(d) {
+		if qN == dbN {
+			return 0
+		}
+		return sc.nd.fromNorms(0, 1, 1)
+	}
+	return d
+}
+
+// warped adds the loudness term to the alignment cost d of query shingle ins and the length database
+// frames from position p
+func (sc *scorer) warped(ins, p, length int, d float64) float64 {
+	if sc.weight != 0 {
+		d += sc.weight * math.Abs(sc.qPower[ins]-sc.powerOver(p, length))
+	}
+	return d
+}
+
+// shingle returns query shingle ins of already chosen and transformed frames q
+func (sc *scorer) shingle(q [][]float64, ins int) Shingle {
+	sh := Shingle{Frames: q[ins*sc.shingleSize : (ins+1)*sc.shingleSize]}
+	if sc.weight != 0 {
+		sh.Power = sc.qPower[ins]
+	}
+	return sh
+}
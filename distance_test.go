@@ -0,0 +1,116 @@
+package spotifaux_test
+
+import (
+	"github.com/stretchr/testify/assert"
+	"math"
+	"math/rand"
+	"spotifaux"
+	"testing"
+)
+
+func Test_matchUsesDistance(t *testing.T) {
+	r := rand.New(rand.NewSource(5))
+	source := testCorpus(t, r, 600, 1)[0]
+	s := testSpotter(r, 12)
+
+	powers := make([]float64, 600)
+	for i := range powers {
+		powers[i] = -60 + 40*r.Float64()
+	}
+	assert.NoError(t, spotifaux.WritePowers(spotifaux.PowerFileName(source.DatFileName), powers))
+	for range s.InShingles {
+		s.InPowers = append(s.InPowers, -60+40*r.Float64())
+	}
+
+	dr, err := spotifaux.NewDatReader(source.DatFileName, testCqtN)
+	assert.NoError(t, err)
+	var frames [][]float64
+	for i := 0; i < dr.Frames; i++ {
+		features, err := dr.Dat()
+		assert.NoError(t, err)
+		frame := make([]float64, len(s.ChosenFeatures))
+		for j, qp := range s.ChosenFeatures {
+			frame[j] = features[qp]
+		}
+		frames = append(frames, frame)
+	}
+	assert.NoError(t, dr.Close())
+
+	cov, err := spotifaux.CorpusCovariance([]spotifaux.FeatureSource{source}, s)
+	assert.NoError(t, err)
+	mahalanobis, err := spotifaux.NewMahalanobis(cov, 1e-6)
+	assert.NoError(t, err)
+
+	distances := []spotifaux.Distance{
+		spotifaux.MatchedFilter{},
+		spotifaux.Cosine{},
+		spotifaux.SquaredEuclidean{},
+		spotifaux.Manhattan{},
+		mahalanobis,
+		spotifaux.PowerAware{Base: spotifaux.Cosine{}, Weight: 0.01},
+		spotifaux.PowerAware{Base: spotifaux.Manhattan{}, Weight: 0.05},
+	}
+	for _, d := range distances {
+		for _, backend := range []spotifaux.MatchBackend{spotifaux.BackendDirect, spotifaux.BackendFFT, spotifaux.BackendAuto} {
+			s.Distance, s.Backend = d, backend
+			result, err := spotifaux.Match(source.Name, source.DatFileName, s)
+			assert.NoError(t, err)
+
+			for ins, candidates := range result.Shingles {
+				q := spotifaux.Shingle{Power: (s.InPowers[ins*4] + s.InPowers[ins*4+1] + s.InPowers[ins*4+2] + s.InPowers[ins*4+3]) / 4}
+				for muxi := 0; muxi < s.ShingleSize; muxi++ {
+					frame := make([]float64, len(s.ChosenFeatures))
+					for j, qp := range s.ChosenFeatures {
+						frame[j] = s.InShingles[ins*s.ShingleSize+muxi][qp]
+					}
+					q.Frames = append(q.Frames, frame)
+				}
+
+				best, bestDist := -1, math.Inf(1)
+				for p := range frames {
+					end := p + s.ShingleSize
+					if end > len(frames) {
+						end = len(frames)
+					}
+					power := 0.0
+					for _, v := range powers[p:end] {
+						power += float64(float32(v)) / float64(end-p)
+					}
+					dist := d.Distance(q, spotifaux.Shingle{Frames: frames[p:end], Power: power})
+					if dist < bestDist {
+						best, bestDist = p, dist
+					}
+				}
+
+				assert.Equal(t, best, candidates.Best().Winner, d.Name())
+				assert.InDelta(t, bestDist, candidates.Best().MinDist, 1e-9, d.Name())
+			}
+		}
+	}
+}
+
+func Test_quantizedBackendRefusesWhatItCannotMatchExactly(t *testing.T) {
+	r := rand.New(rand.NewSource(6))
+	source := testCorpus(t, r, 300, 1)[0]
+	s := testSpotter(r, 12)
+	s.Backend = spotifaux.BackendQuantized
+	_, err := spotifaux.Match(source.Name, source.DatFileName, s)
+	assert.NoError(t, err)
+
+	cov, err := spotifaux.CorpusCovariance([]spotifaux.FeatureSource{source}, s)
+	assert.NoError(t, err)
+	s.Distance, err = spotifaux.NewMahalanobis(cov, 1e-6)
+	assert.NoError(t, err)
+	_, err = spotifaux.Match(source.Name, source.DatFileName, s)
+	assert.Error(t, err)
+
+	// auto falls back to a backend that can
+	s.Backend = spotifaux.BackendAuto
+	_, err = spotifaux.Match(source.Name, source.DatFileName, s)
+	assert.NoError(t, err)
+
+	s.Distance, s.Backend = nil, spotifaux.BackendQuantized
+	s.InShingles[5][s.ChosenFeatures[0]] += 0.001
+	_, err = spotifaux.Match(source.Name, source.DatFileName, s)
+	assert.Error(t, err)
+}
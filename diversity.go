@@ -0,0 +1,99 @@
+package spotifaux
+
+import "math"
+
+// Diversity limits how often the same database audio is reused in a recipe, so that a small corpus
+// does not repeat one spot over and over. A segment is the audio of a unit in a file, and units that
+// overlap in a file, as those starting less than a shingle apart do, count as the same segment.
+type Diversity struct {
+	MaxUses      int     // times a segment may be used, 0 for no limit
+	MinGap       int     // query frames before a segment may be used again, 0 for no limit
+	MaxFileShare float64 // largest fraction of the output frames that may come from one file, 0 for no limit
+	ExcludeDat   string  // dat file of the query, whose audio is left out of the corpus if set
+}
+
+// use is a unit taken from a file
+type use struct {
+	position, span int // frames of the unit in its file
+	query          int // position of the query shingle it was used for
+}
+
+// Sources returns the sources other than the query. Dat files are cached by the content of their audio,
+// so a copy of the query anywhere in the corpus has the same dat.
+func (d *Diversity) Sources(sources []FeatureSource) []FeatureSource {
+	if d.ExcludeDat == "" {
+		return sources
+	}
+	var kept []FeatureSource
+	for _, source := range sources {
+		if source.DatFileName != d.ExcludeDat {
+			kept = append(kept, source)
+		}
+	}
+	return kept
+}
+
+// Apply goes through winners in query order, replacing each that breaks a limit with the best candidate
+// of its shingle in result that does not, or with silence if every candidate does. Give the query shingles
+// enough candidates with TopK for there to be alternatives. The first unit from a file is always within
+// MaxFileShare, however short the output.
+func (d *Diversity) Apply(winners []Winner, result *MatchResult) []Winner {
+	maxFileFrames := math.Inf(1)
+	if d.MaxFileShare > 0 {
+		frames := 0
+		for _, w := range winners {
+			frames += w.span(result.ShingleSize)
+		}
+		maxFileFrames = d.MaxFileShare * float64(frames)
+	}
+
+	uses := map[string][]use{} // units used from each file, in query order
+	fileFrames := map[string]int{}
+	allowed := func(w Winner) bool {
+		span := w.span(result.ShingleSize)
+		if len(uses[w.File]) > 0 && float64(fileFrames[w.File]+span) > maxFileFrames {
+			return false
+		}
+		segmentUses := 0
+		for _, u := range uses[w.File] {
+			if u.position >= w.Winner+span || w.Winner >= u.position+u.span {
+				continue
+			}
+			segmentUses++
+			if d.MaxUses > 0 && segmentUses >= d.MaxUses {
+				return false
+			}
+			if w.Query-u.query < d.MinGap {
+				return false
+			}
+		}
+		return true
+	}
+
+	out := make([]Winner, len(winners))
+	for i, w := range winners {
+		out[i] = w
+		if w.Winner < 0 {
+			continue
+		}
+
+		if !allowed(w) {
+			out[i] = Winner{Query: w.Query, Winner: -1, MinDist: math.Inf(1)}
+			for _, c := range result.Shingles[w.Query/result.QueryHop].Winners() {
+				c.Query = w.Query
+				if allowed(c) {
+					out[i] = c
+					break
+				}
+			}
+			if out[i].Winner < 0 {
+				continue
+			}
+		}
+
+		span := out[i].span(result.ShingleSize)
+		uses[out[i].File] = append(uses[out[i].File], use{out[i].Winner, span, out[i].Query})
+		fileFrames[out[i].File] += span
+	}
+	return out
+}
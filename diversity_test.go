@@ -0,0 +1,117 @@
+package spotifaux_test
+
+import (
+	"github.com/stretchr/testify/assert"
+	"math"
+	"math/rand"
+	"spotifaux"
+	"testing"
+)
+
+func Test_diversityLimitsReuse(t *testing.T) {
+	r := rand.New(rand.NewSource(9))
+	s := testSpotter(r, 16)
+
+	// every shingle's best is a@5, then b@7 and b@20
+	result := spotifaux.NewMatchResult(4, s)
+	for _, c := range result.Shingles {
+		c.Push(spotifaux.Winner{File: "a", Winner: 5, MinDist: 0.1})
+		c.Push(spotifaux.Winner{File: "b", Winner: 7, MinDist: 0.2})
+		c.Push(spotifaux.Winner{File: "b", Winner: 20, MinDist: 0.3})
+	}
+	for _, test := range []struct {
+		diversity spotifaux.Diversity
+		want      [][2]interface{}
+	}{
+		{spotifaux.Diversity{}, [][2]interface{}{{"a", 5}, {"a", 5}, {"a", 5}, {"a", 5}}},
+		{spotifaux.Diversity{MaxUses: 2}, [][2]interface{}{{"a", 5}, {"a", 5}, {"b", 7}, {"b", 7}}},
+		{spotifaux.Diversity{MaxUses: 1}, [][2]interface{}{{"a", 5}, {"b", 7}, {"b", 20}, {"", -1}}},
+		{spotifaux.Diversity{MinGap: 8}, [][2]interface{}{{"a", 5}, {"b", 7}, {"a", 5}, {"b", 7}}},
+		{spotifaux.Diversity{MaxFileShare: 0.5}, [][2]interface{}{{"a", 5}, {"a", 5}, {"b", 7}, {"b", 7}}},
+	} {
+		winners := test.diversity.Apply(result.Winners(), result)
+		for i, w := range winners {
+			assert.Equal(t, 4*i, w.Query)
+			assert.Equal(t, test.want[i][0], w.File, "%+v", test.diversity)
+			assert.Equal(t, test.want[i][1], w.Winner, "%+v", test.diversity)
+		}
+		if test.want[3][1] == -1 {
+			assert.True(t, math.IsInf(winners[3].MinDist, 1))
+		}
+	}
+
+	sources := []spotifaux.FeatureSource{{Name: "a", DatFileName: "x.dat"}, {Name: "b", DatFileName: "y.dat"}}
+	d := spotifaux.Diversity{ExcludeDat: "x.dat"}
+	assert.Equal(t, sources[1:], d.Sources(sources))
+}
+
+func Test_diversityCountsOverlappingUnitsAsOneSegment(t *testing.T) {
+	r := rand.New(rand.NewSource(42))
+	s := testSpotter(r, 12)
+
+	// a@5 and a@8 share three of their four frames, a@9 shares none with a@5
+	result := spotifaux.NewMatchResult(3, s)
+	for _, c := range result.Shingles {
+		c.Push(spotifaux.Winner{File: "a", Winner: 5, MinDist: 0.1})
+		c.Push(spotifaux.Winner{File: "a", Winner: 8, MinDist: 0.2})
+		c.Push(spotifaux.Winner{File: "a", Winner: 9, MinDist: 0.3})
+	}
+	for _, test := range []struct {
+		diversity spotifaux.Diversity
+		want      []int
+	}{
+		{spotifaux.Diversity{MaxUses: 1}, []int{5, 9, -1}},
+		{spotifaux.Diversity{MaxUses: 2}, []int{5, 5, 9}},
+		{spotifaux.Diversity{MinGap: 8}, []int{5, 9, 5}},
+	} {
+		winners := test.diversity.Apply(result.Winners(), result)
+		for i, w := range winners {
+			assert.Equal(t, test.want[i], w.Winner, "%+v", test.diversity)
+		}
+	}
+
+	// a longer unit covers more of its file
+	winners := result.Winners()
+	winners[0].Span = 8
+	winners = (&spotifaux.Diversity{MaxUses: 1}).Apply(winners, result)
+	assert.Equal(t, []int{5, -1, -1}, []int{winners[0].Winner, winners[1].Winner, winners[2].Winner})
+}
+
+func Test_diversityReplacesFromEachUnitsOwnShingle(t *testing.T) {
+	r := rand.New(rand.NewSource(43))
+	s := testSpotter(r, 16)
+
+	// shingle i has a@5 first and b@(10i) second
+	result := spotifaux.NewMatchResult(4, s)
+	for i, c := range result.Shingles {
+		c.Push(spotifaux.Winner{File: "a", Winner: 5, MinDist: 0.1})
+		c.Push(spotifaux.Winner{File: "b", Winner: 10 * i, MinDist: 0.2})
+	}
+
+	// the winners of only the later shingles, as left once others are dropped
+	winners := (&spotifaux.Diversity{MaxUses: 1}).Apply(result.Winners()[2:], result)
+	assert.Equal(t, []int{8, 12}, []int{winners[0].Query, winners[1].Query})
+	assert.Equal(t, []int{5, 30}, []int{winners[0].Winner, winners[1].Winner})
+	assert.Equal(t, "b", winners[1].File)
+}
+
+func Test_diversityFileShareCountsFrames(t *testing.T) {
+	r := rand.New(rand.NewSource(44))
+	s := testSpotter(r, 16)
+
+	result := spotifaux.NewMatchResult(4, s)
+	for i, c := range result.Shingles {
+		c.Push(spotifaux.Winner{File: "a", Winner: 10 * i, MinDist: 0.1})
+		c.Push(spotifaux.Winner{File: "b", Winner: 10 * i, MinDist: 0.2})
+	}
+
+	// a's first unit is 12 of the 24 frames, so a has no room left for another
+	winners := result.Winners()
+	winners[0].Span = 12
+	winners = (&spotifaux.Diversity{MaxFileShare: 0.5}).Apply(winners, result)
+	var files []string
+	for _, w := range winners {
+		files = append(files, w.File)
+	}
+	assert.Equal(t, []string{"a", "b", "b", "b"}, files)
+}
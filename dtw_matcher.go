@@ -0,0 +1,196 @@
+package spotifaux
+
+import "math"
+
+// Dynamic time warping lets a query shingle match the same gesture played at a different tempo. Each
+// query shingle is aligned frame by frame to database windows of every length from
+// ShingleSize/MaxStretch to ShingleSize*MaxStretch frames, the alignment staying within WarpBand
+// frames of the diagonal (a Sakoe-Chiba band), and the winner records the length of its window.
+
+// warps reports whether s matches shingles by dynamic time warping rather than rigidly
+func (s *SoundSpotter) warps() bool {
+	return s.MaxStretch > 1
+}
+
+// warpLengths returns the shortest and longest database windows a query shingle is aligned to and the
+// band radius. Windows further than the band from ShingleSize frames cannot be reached, so are dropped.
+func (s *SoundSpotter) warpLengths() (minLength, maxLength, band int) {
+	minLength = int(math.Ceil(float64(s.ShingleSize)/s.MaxStretch - 1e-9))
+	maxLength = int(math.Floor(float64(s.ShingleSize)*s.MaxStretch + 1e-9))
+	band = s.WarpBand
+	if band <= 0 {
+		band = maxLength - s.ShingleSize
+	}
+	if minLength < s.ShingleSize-band {
+		minLength = s.ShingleSize - band
+	}
+	if maxLength > s.ShingleSize+band {
+		maxLength = s.ShingleSize + band
+	}
+	if minLength < 1 {
+		minLength = 1
+	}
+	return minLength, maxLength, band
+}
+
+// matchDTW matches database positions [from, to) by dynamic time warping. The local cost of each
+// query frame against each frame of a block's window is computed once, and the alignments starting at
+// each position are found from these. Backend and PruneFeatures do not apply.
+func matchDTW(t *tracker, fileName string, dr *datReader, s *SoundSpotter, sc *scorer,
+	from, to int) (*MatchResult, error) {
+
+	x := queryShingles(s)
+	result := NewMatchResult(x, s)
+	minLength, maxLength, band := s.warpLengths()
+
+	q := queryFrames(s, sc.features)
+	qN := make([]float64, len(q))
+	for i := range q {
+		qN[i] = math.Sqrt(dot(q[i], q[i]))
+	}
+
+	window := matchBlock + maxLength - 1
+	db := make([][]float64, 0, window) // database frames from b0
+	dbN := make([]float64, window)
+	C := make([][]float64, len(q)) // local costs, query frame x database frame
+	for i := range C {
+		C[i] = make([]float64, window)
+	}
+	a := newAligner(s.ShingleSize, maxLength, band)
+
+	for b0 := from; b0 < to; b0 += matchBlock {
+		b1 := b0 + matchBlock
+		if b1 > to {
+			b1 = to
+		}
+		end := b1 + maxLength - 1
+		if end > dr.Frames {
+			end = dr.Frames
+		}
+
+		// keep the frames shared with the previous block's window and read the rest
+		if len(db) > 0 {
+			db = append(db[:0], db[matchBlock:]...)
+		}
+		for j := b0 + len(db); j < end; j++ {
+			features, err := dr.Dat()
+			if err != nil {
+				return nil, err
+			}
+			db = append(db, sc.features(features))
+		}
+		w := len(db)
+
+		for j := 0; j < w; j++ {
+			dbN[j] = math.Sqrt(dot(db[j], db[j]))
+		}
+		for qi := range q {
+			for j := 0; j < w; j++ {
+				C[qi][j] = sc.frameCost(q[qi], db[j], qN[qi], dbN[j])
+			}
+		}
+
+		result.Pairs += x * (b1 - b0)
+		for ins := 0; ins < x; ins++ {
+			candidates := result.Shingles[ins]
+			cost := C[ins*s.ShingleSize : (ins+1)*s.ShingleSize]
+			for p := 0; p < b1-b0; p++ {
+				length, dRadius := a.align(cost, p, w-p, minLength)
+				if length == 0 {
+					continue
+				}
+				dRadius = sc.warped(ins, b0+p, length, dRadius)
+
+				// Perform min-dist search
+				if dRadius < candidates.Worst() || candidates.Len() == 0 {
+					candidates.Push(Winner{
+						File:    fileName,
+						MinDist: dRadius,
+						Winner:  b0 + p,
+						Length:  length,
+					})
+				}
+			}
+		}
+
+		err := t.advance(b1-b0, result)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// aligner finds the cheapest alignment of a query shingle to database windows starting at a position.
+// Steps along either axis cost the local cost and diagonal steps twice it, so dividing the accumulated
+// cost by the sum of the lengths gives the mean frame distance along the path, comparable between windows.
+type aligner struct {
+	shingleSize int
+	maxLength   int
+	band        int
+	limit       int         // window frames available in the current alignment
+	D           [][]float64 // accumulated cost, query frame x window frame
+}
+
+func newAligner(shingleSize, maxLength, band int) *aligner {
+	D := make([][]float64, shingleSize)
+	for i := range D {
+		D[i] = make([]float64, maxLength)
+	}
+	return &aligner{shingleSize: shingleSize, maxLength: maxLength, band: band, D: D}
+}
+
+// at is the accumulated cost of cell (i, j), +Inf outside the band
+func (a *aligner) at(i, j int) float64 {
+	if i < 0 || j < 0 || j >= a.limit || j < i-a.band || j > i+a.band {
+		return math.Inf(1)
+	}
+	return a.D[i][j]
+}
+
+// align aligns the query shingle with local costs cost to the windows from position p of at least
+// minLength and at most frames frames, and returns the length of the best window and its distance, or
+// a length of 0 if no window fits
+func (a *aligner) align(cost [][]float64, p, frames, minLength int) (int, float64) {
+	a.limit = a.maxLength
+	if a.limit > frames {
+		a.limit = frames
+	}
+	if a.limit < minLength {
+		return 0, math.Inf(1)
+	}
+
+	for i := 0; i < a.shingleSize; i++ {
+		lo, hi := i-a.band, i+a.band
+		if lo < 0 {
+			lo = 0
+		}
+		if hi > a.limit-1 {
+			hi = a.limit - 1
+		}
+		for j := lo; j <= hi; j++ {
+			c := cost[i][p+j]
+			if i == 0 && j == 0 {
+				a.D[i][j] = 2 * c
+				continue
+			}
+			a.D[i][j] = math.Min(a.at(i-1, j-1)+2*c, math.Min(a.at(i-1, j), a.at(i, j-1))+c)
+		}
+	}
+
+	// prefer the unstretched window on ties
+	best, bestDist := 0, math.Inf(1)
+	if a.shingleSize <= a.limit {
+		best, bestDist = a.shingleSize, a.at(a.shingleSize-1, a.shingleSize-1)/float64(2*a.shingleSize)
+	}
+	for length := minLength; length <= a.limit; length++ {
+		d := a.at(a.shingleSize-1, length-1) / float64(a.shingleSize+length)
+		if d < bestDist {
+			best, bestDist = length, d
+		}
+	}
+	if math.IsInf(bestDist, 1) {
+		return 0, bestDist
+	}
+	return best, bestDist
+}
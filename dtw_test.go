@@ -0,0 +1,68 @@
+package spotifaux_test
+
+import (
+	"github.com/stretchr/testify/assert"
+	"math"
+	"math/rand"
+	"spotifaux"
+	"testing"
+)
+
+func Test_matchDTWFindsStretchedShingle(t *testing.T) {
+	r := rand.New(rand.NewSource(6))
+	s := testSpotter(r, 16)
+	s.ShingleSize = 8
+	s.TopK = 1
+
+	// the second query shingle played 1.25 times slower, at frame 300 of the database
+	query := quantizeFrames(s.InShingles)
+	frames := randomFrames(r, 600)
+	for j := 0; j < 10; j++ {
+		frames[300+j] = query[8+int(math.Round(float64(j)*7/9))]
+	}
+	source := testCorpus(t, r, 600)[0]
+	writeTestDat(t, source.DatFileName, frames)
+
+	rigid, err := spotifaux.Match(source.Name, source.DatFileName, s)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, rigid.Shingles[1].Best().Length)
+
+	s.MaxStretch = 1.3
+	for _, d := range []spotifaux.Distance{spotifaux.MatchedFilter{}, spotifaux.Manhattan{}} {
+		s.Distance = d
+		result, err := spotifaux.Match(source.Name, source.DatFileName, s)
+		assert.NoError(t, err)
+		best := result.Shingles[1].Best()
+		assert.Equal(t, 300, best.Winner, d.Name())
+		assert.Equal(t, 10, best.Length, d.Name())
+		assert.InDelta(t, 0, best.MinDist, 1e-9, d.Name())
+		assert.Less(t, best.MinDist, rigid.Shingles[1].Best().MinDist)
+	}
+
+	// the band keeps the alignment within a frame of the diagonal
+	s.WarpBand = 1
+	result, err := spotifaux.Match(source.Name, source.DatFileName, s)
+	assert.NoError(t, err)
+	assert.LessOrEqual(t, result.Shingles[1].Best().Length, 9)
+}
+
+func Test_timeStretchKeepsPitch(t *testing.T) {
+	in := make([]float64, 1600)
+	for i := range in {
+		in[i] = math.Sin(2 * math.Pi * 440 * float64(i) / spotifaux.SAMPLE_RATE)
+	}
+
+	for _, n := range []int{1280, 2000} {
+		out := spotifaux.TimeStretch(in, n)
+		assert.Len(t, out, n)
+
+		crossings := 0
+		for i := 1; i < n; i++ {
+			if (out[i-1] < 0) != (out[i] < 0) {
+				crossings++
+			}
+		}
+		hz := float64(crossings) / 2 / (float64(n) / spotifaux.SAMPLE_RATE)
+		assert.InDelta(t, 440, hz, 20)
+	}
+}
@@ -0,0 +1,219 @@
+package spotifaux
+
+import (
+	"fmt"
+	"math"
+)
+
+// Explanation breaks the distance of a match down, to show which features and frames it comes from
+type Explanation struct {
+	Query        int           `json:"query"` // first query frame of the shingle
+	File         string        `json:"file"`
+	Winner       int           `json:"winner"` // first database frame of the shingle
+	Transpose    int           `json:"transpose,omitempty"`
+	Reversed     bool          `json:"reversed,omitempty"`
+	Gain         float64       `json:"gain,omitempty"`
+	DistanceName string        `json:"distance_name"`
+	Distance     float64       `json:"distance"`
+	Power        float64       `json:"power"`         // loudness term of a PowerAware distance, included in Distance
+	QueryNorm    float64       `json:"query_norm"`    // of the chosen, transformed features of the shingle
+	DatabaseNorm float64       `json:"database_norm"` // likewise
+	Cross        float64       `json:"cross"`         // cross term of the two shingles
+	Features     []FeatureTerm `json:"features,omitempty"`
+	Frames       []FrameTerm   `json:"frames,omitempty"`
+	Rank         int           `json:"rank,omitempty"`       // among the candidates, 1 for the best, 0 without candidates
+	Candidates   int           `json:"candidates,omitempty"` // the match kept for the query shingle
+}
+
+// FeatureTerm is the share of the distance from one feature over every frame of the shingle. Under a
+// Mahalanobis distance the features are the whitened ones, each decorrelated from those chosen before it.
+type FeatureTerm struct {
+	Coefficient int     `json:"coefficient"` // index into the feature vector, an entry of ChosenFeatures
+	Distance    float64 `json:"distance"`
+}
+
+// FrameTerm is the share of the distance from one frame of the shingle over every feature
+type FrameTerm struct {
+	Query    int     `json:"query"`    // query frame
+	Database int     `json:"database"` // database frame, past the end of the file if it counts as zeros
+	Distance float64 `json:"distance"`
+}
+
+// elementwise is a Distance that is a sum over the elements of the two shingles, so can be broken down
+// by feature and frame. element is the term of query element q and database element db in shingles
+// with norms qN and dbN.
+type elementwise interface {
+	element(q, db, qN, dbN float64) float64
+}
+
+func (MatchedFilter) element(q, db, qN, dbN float64) float64 {
+	d := q/qN - db/dbN
+	return d * d
+}
+
+func (Cosine) element(q, db, qN, dbN float64) float64 {
+	return MatchedFilter{}.element(q, db, qN, dbN) / 2
+}
+
+func (SquaredEuclidean) element(q, db, qN, dbN float64) float64 {
+	return (q - db) * (q - db)
+}
+
+func (Manhattan) element(q, db, qN, dbN float64) float64 {
+	return math.Abs(q - db)
+}
+
+// element is on the whitened features, where the distance is squared Euclidean
+func (*Mahalanobis) element(q, db, qN, dbN float64) float64 {
+	return SquaredEuclidean{}.element(q, db, qN, dbN)
+}
+
+// elementsOf returns the elementwise distance of d without its loudness term, or nil if d has none
+func elementsOf(d Distance) elementwise {
+	switch d := d.(type) {
+	case PowerAware:
+		return elementsOf(d.Base)
+	case *PowerAware:
+		return elementsOf(d.Base)
+	case elementwise:
+		return d
+	}
+	return nil
+}
+
+// Explain breaks down the distance of w, a match of the query of s against sources, by feature and by
+// frame. Its rank is among candidates, the match kept for its query shingle, which may be nil. The query
+// shingle is found from w.Query, so w need not come from a match with the query hop of s.
+func (s *SoundSpotter) Explain(sources []FeatureSource, w Winner, candidates *Candidates) (*Explanation, error) {
+	if w.Winner < 0 {
+		return nil, fmt.Errorf("query frame %d has no database match to explain", w.Query)
+	}
+	if w.Query < 0 || w.Query >= len(s.InShingles) {
+		return nil, fmt.Errorf("query frame %d is outside the query of %d frames", w.Query, len(s.InShingles))
+	}
+	v := *s // matching only the shingle of w, which is query shingle 0 of v
+	v.ShingleSize, v.QueryHop = w.span(s.ShingleSize), 1
+	v.InShingles = s.InShingles[w.Query:]
+	if len(s.InPowers) > w.Query {
+		v.InPowers = s.InPowers[w.Query:]
+	}
+	if w.length(s.ShingleSize) != v.ShingleSize {
+		return nil, fmt.Errorf("%s at %d is time warped, which is not explained", w.File, w.Winner)
+	}
+	v.transform = Transform{Transpose: w.Transpose, Reversed: w.Reversed, Gain: w.Gain}
+	if w.Transpose != 0 {
+		transposed := s.InTransposed[w.Transpose]
+		if len(transposed) <= w.Query {
+			return nil, fmt.Errorf("no query frames transposed by %d semitones", -w.Transpose)
+		}
+		v.InShingles = transposed[w.Query:]
+	}
+	datFileName := ""
+	for _, source := range sources {
+		if source.Name == w.File {
+			datFileName = source.DatFileName
+		}
+	}
+	if datFileName == "" {
+		return nil, fmt.Errorf("%s is not a source", w.File)
+	}
+
+	sc, err := newScorer(&v)
+	if err != nil {
+		return nil, err
+	}
+	if err = sc.load(datFileName); err != nil {
+		return nil, err
+	}
+	q := make([][]float64, v.ShingleSize)
+	for muxi := range q {
+		q[muxi] = sc.features(queryFrame(&v, 0, muxi))
+	}
+	db, err := readShingle(datFileName, &v, sc, w.Winner)
+	if err != nil {
+		return nil, err
+	}
+
+	e := &Explanation{Query: w.Query, File: w.File, Winner: w.Winner, Transpose: w.Transpose, Reversed: w.Reversed,
+		Gain: w.Gain, DistanceName: sc.d.Name()}
+	e.Cross, e.QueryNorm, e.DatabaseNorm = norms(q, db)
+	if sc.weight != 0 {
+		e.Power = sc.weight * math.Abs(sc.qPower[0]-sc.power(w.Winner))
+	}
+	if el := elementsOf(sc.d); el != nil {
+		e.Features = make([]FeatureTerm, len(v.ChosenFeatures))
+		for k, coefficient := range v.ChosenFeatures {
+			e.Features[k].Coefficient = coefficient
+		}
+		e.Frames = make([]FrameTerm, v.ShingleSize)
+		e.Distance = e.Power
+		for muxi := range q {
+			e.Frames[muxi] = FrameTerm{Query: w.Query + muxi, Database: w.Winner + muxi}
+			if v.transform.Reversed {
+				e.Frames[muxi].Query = w.Query + v.ShingleSize - 1 - muxi
+			}
+			for k := range q[muxi] {
+				d := el.element(q[muxi][k], db[muxi][k], e.QueryNorm, e.DatabaseNorm)
+				e.Features[k].Distance += d
+				e.Frames[muxi].Distance += d
+				e.Distance += d
+			}
+		}
+	} else {
+		e.Distance = sc.d.Distance(sc.shingle(q, 0), Shingle{Frames: db, Power: sc.power(w.Winner)})
+	}
+	if math.IsNaN(e.Distance) || math.IsInf(e.Distance, 0) {
+		return nil, fmt.Errorf("the distance of query frame %d from %s at %d is undefined, as one of them is silent",
+			w.Query, w.File, w.Winner)
+	}
+
+	if candidates != nil {
+		e.Candidates = candidates.Len()
+		e.Rank = 1
+		explained := Winner{File: w.File, Winner: w.Winner, MinDist: e.Distance}
+		for i, c := range candidates.Winners() {
+			if c.File == w.File && c.Winner == w.Winner && c.Transpose == w.Transpose && c.Reversed == w.Reversed &&
+				c.Gain == w.Gain {
+				e.Rank = i + 1 // its own distance, not one recomputed slightly differently, decides ties
+				break
+			}
+			if better(c, explained) {
+				e.Rank++
+			}
+		}
+	}
+	return e, nil
+}
+
+// readShingle reads the s.ShingleSize database frames from position p, chosen and transformed for the
+// distance, the frames past the end of the file being zeros
+func readShingle(datFileName string, s *SoundSpotter, sc *scorer, p int) ([][]float64, error) {
+	dr, err := NewDatReader(datFileName, s.CqtN)
+	if err != nil {
+		return nil, err
+	}
+	defer dr.Close()
+	if err = dr.checkChosen(s.ChosenFeatures); err != nil {
+		return nil, err
+	}
+	if p >= dr.Frames {
+		return nil, fmt.Errorf("%s has no frame %d", datFileName, p)
+	}
+	if err = dr.Seek(p); err != nil {
+		return nil, err
+	}
+
+	db := make([][]float64, s.ShingleSize)
+	for muxi := range db {
+		if p+muxi < dr.Frames {
+			features, err := dr.Dat()
+			if err != nil {
+				return nil, err
+			}
+			db[muxi] = sc.features(features)
+		} else {
+			db[muxi] = make([]float64, len(s.ChosenFeatures))
+		}
+	}
+	return db, nil
+}
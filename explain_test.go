@@ -0,0 +1,68 @@
+package spotifaux_test
+
+import (
+	"github.com/stretchr/testify/assert"
+	"math/rand"
+	"spotifaux"
+	"testing"
+)
+
+func Test_explainBreaksDownMatchDistance(t *testing.T) {
+	r := rand.New(rand.NewSource(23))
+	sources := testCorpus(t, r, 400, 1)[:1]
+	s := testSpotter(r, 14)
+	s.QueryHop, s.Reverse = 3, true
+
+	powers := make([]float64, 400)
+	for i := range powers {
+		powers[i] = -60 + 40*r.Float64()
+	}
+	assert.NoError(t, spotifaux.WritePowers(spotifaux.PowerFileName(sources[0].DatFileName), powers))
+	for range s.InShingles {
+		s.InPowers = append(s.InPowers, -60+40*r.Float64())
+	}
+
+	cov, err := spotifaux.CorpusCovariance(sources, s)
+	assert.NoError(t, err)
+	mahalanobis, err := spotifaux.NewMahalanobis(cov, 1e-6)
+	assert.NoError(t, err)
+
+	for _, d := range []spotifaux.Distance{
+		spotifaux.MatchedFilter{},
+		mahalanobis,
+		spotifaux.PowerAware{Base: spotifaux.Manhattan{}, Weight: 0.05},
+	} {
+		s.Distance = d
+		result, err := spotifaux.Match(sources[0].Name, sources[0].DatFileName, s)
+		assert.NoError(t, err)
+
+		for ins, candidates := range result.Shingles {
+			for rank, w := range candidates.Winners() {
+				w.Query = ins * result.QueryHop
+				e, err := s.Explain(sources, w, candidates)
+				assert.NoError(t, err, d.Name())
+				assert.InDelta(t, w.MinDist, e.Distance, 1e-9, d.Name())
+				assert.Equal(t, rank+1, e.Rank, d.Name())
+				assert.Equal(t, candidates.Len(), e.Candidates)
+				assert.Equal(t, w.Reversed, e.Reversed)
+
+				features, frames := e.Power, e.Power
+				for k, term := range e.Features {
+					assert.Equal(t, s.ChosenFeatures[k], term.Coefficient)
+					features += term.Distance
+				}
+				for _, term := range e.Frames {
+					frames += term.Distance
+				}
+				assert.Len(t, e.Frames, s.ShingleSize)
+				assert.InDelta(t, e.Distance, features, 1e-9, d.Name())
+				assert.InDelta(t, e.Distance, frames, 1e-9, d.Name())
+				assert.Greater(t, e.QueryNorm, 0.0)
+				assert.Greater(t, e.DatabaseNorm, 0.0)
+			}
+		}
+	}
+
+	_, err = s.Explain(sources, spotifaux.Winner{File: "elsewhere", Winner: 3}, nil)
+	assert.Error(t, err)
+}
@@ -0,0 +1,18 @@
+package spotifaux
+
+var MatchBruteForce = matchBruteForce
+var WritePowers = writePowers
+var TimeStretch = timeStretch
+var PitchShift = pitchShift
+var WriteNpyHeader = writeNpyHeader
+var ReadNpyHeader = readNpyHeader
+var MatchBackendFor = (*SoundSpotter).matchBackend
+
+func MatchRange(fileName, datFileName string, s *SoundSpotter, from, to int) (*MatchResult, error) {
+	return matchRange(nil, fileName, datFileName, s, from, to)
+}
+
+// Decoded returns the names of the files r keeps decoded, read least recently first
+func (r *AudioReader) Decoded() []string {
+	return r.order
+}
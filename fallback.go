@@ -0,0 +1,172 @@
+package spotifaux
+
+import (
+	"context"
+	"math"
+	"sort"
+)
+
+// Fallback is what a query shingle gets when no candidate is within MaxDistance
+type Fallback int
+
+const (
+	FallbackSilence     Fallback = iota
+	FallbackPassthrough          // the query's own audio
+	FallbackHold                 // the previous unit carries on
+	FallbackCorpus               // the best candidate from a fallback corpus
+)
+
+func (f Fallback) String() string {
+	switch f {
+	case FallbackPassthrough:
+		return "passthrough"
+	case FallbackHold:
+		return "hold"
+	case FallbackCorpus:
+		return "corpus"
+	}
+	return "silence"
+}
+
+// Threshold returns the candidates of result within s.MaxDistance, all of them if it is 0
+func (s *SoundSpotter) Threshold(result *MatchResult) *MatchResult {
+	if s.MaxDistance <= 0 {
+		return result
+	}
+	within := &MatchResult{
+		Shingles:    make([]*Candidates, len(result.Shingles)),
+		ShingleSize: result.ShingleSize,
+		QueryHop:    result.QueryHop,
+		Pairs:       result.Pairs,
+		Pruned:      result.Pruned,
+	}
+	for i, c := range result.Shingles {
+		within.Shingles[i] = NewCandidates(c.K, c.MinSeparation)
+		for _, w := range c.Winners() {
+			if dist(w) <= s.MaxDistance {
+				within.Shingles[i].Push(w)
+			}
+		}
+	}
+	return within
+}
+
+// FallBack replaces the silent winners, those of shingles left without a candidate by Threshold or
+// by Diversity, with s.Fallback and records it in the winner. A held unit carries on in its file from
+// where the previous unit would have got to, and is silent if there is no previous unit or a reversed
+// one reached the start of its file. A passthrough unit is at the query position, for rendering from
+// the query's audio. fallback holds the candidates of the fallback corpus for FallbackCorpus, found by
+// query position, as MatchFallback returns them.
+func (s *SoundSpotter) FallBack(winners []Winner, fallback *MatchResult) []Winner {
+	out := make([]Winner, len(winners))
+	for i, w := range winners {
+		out[i] = w
+		if w.Winner >= 0 {
+			continue
+		}
+
+		unit := Winner{Query: w.Query, Span: w.Span, Winner: -1, MinDist: math.Inf(1), Fallback: s.Fallback.String()}
+		switch s.Fallback {
+		case FallbackPassthrough:
+			unit.Winner = w.Query
+		case FallbackHold:
+			if i > 0 && out[i-1].Winner >= 0 && out[i-1].File != "" {
+				prev := out[i-1]
+				unit.File = prev.File
+				if prev.Length > 0 {
+					// as fast through the file as the previous unit
+					rate := float64(prev.Length) / float64(prev.span(s.ShingleSize))
+					unit.Length = int(math.Round(rate * float64(w.span(s.ShingleSize))))
+				}
+				unit.Transpose, unit.Reversed, unit.Gain = prev.Transpose, prev.Reversed, prev.Gain
+				if next := continuation(prev, w.Query-prev.Query, s.ShingleSize); next >= 0 {
+					unit.Winner = next
+				}
+			}
+		case FallbackCorpus:
+			if fallback == nil {
+				break
+			}
+			if j := w.Query / fallback.QueryHop; j < len(fallback.Shingles) {
+				if best := fallback.Shingles[j].Best(); best.Winner >= 0 {
+					best.Query, best.Span, best.Fallback = w.Query, w.Span, s.Fallback.String()
+					unit = best
+				}
+			}
+		}
+		out[i] = unit
+	}
+	return out
+}
+
+// MatchFallback matches the fallback corpus sources for the query shingles of the silent winners
+// alone, as those are all FallBack looks up, and returns their candidates by query shingle with the
+// other shingles left without any. winners may hold the units of several recipes. It returns nil
+// without matching if no winner is silent.
+func (s *SoundSpotter) MatchFallback(ctx context.Context, m *CorpusMatcher, sources []FeatureSource,
+	winners []Winner, progress ProgressFunc) (*MatchResult, error) {
+
+	hop, x := s.queryHop(), queryShingles(s)
+	silent := map[int]bool{}
+	for _, w := range winners {
+		if j := w.Query / hop; w.Winner < 0 && j < x {
+			silent[j] = true
+		}
+	}
+	if len(silent) == 0 {
+		return nil, nil
+	}
+	var shingles []int
+	for j := range silent {
+		shingles = append(shingles, j)
+	}
+	sort.Ints(shingles)
+
+	// the silent shingles one after another, padded past the end of the query as queryFrame does
+	var at []int
+	for _, j := range shingles {
+		for muxi := 0; muxi < s.ShingleSize; muxi++ {
+			at = append(at, j*hop+muxi)
+		}
+	}
+	pick := func(frames [][]float64) [][]float64 {
+		picked := make([][]float64, len(at))
+		for k, i := range at {
+			if i < len(frames) {
+				picked[k] = frames[i]
+			} else {
+				picked[k] = make([]float64, len(frames[0]))
+			}
+		}
+		return picked
+	}
+	t := *s
+	t.QueryHop = s.ShingleSize
+	t.InShingles = pick(s.InShingles)
+	if s.InTransposed != nil {
+		t.InTransposed = map[int][][]float64{}
+		for k, frames := range s.InTransposed {
+			t.InTransposed[k] = pick(frames)
+		}
+	}
+	if s.InPowers != nil {
+		t.InPowers = make([]float64, len(at))
+		for k, i := range at {
+			t.InPowers[k] = silenceDB
+			if i < len(s.InPowers) {
+				t.InPowers[k] = s.InPowers[i]
+			}
+		}
+	}
+
+	picked, err := m.MatchContext(ctx, sources, &t, progress)
+	if err != nil {
+		return nil, err
+	}
+	result := NewMatchResult(x, s)
+	result.Pairs, result.Pruned = picked.Pairs, picked.Pruned
+	for k, j := range shingles {
+		result.Shingles[j] = picked.Shingles[k]
+	}
+	return result, nil
+}
@@ -0,0 +1,88 @@
+package spotifaux_test
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"math/rand"
+	"spotifaux"
+	"testing"
+)
+
+func Test_thresholdFallsBack(t *testing.T) {
+	r := rand.New(rand.NewSource(11))
+	s := testSpotter(r, 12)
+	s.MaxDistance = 0.5
+
+	result := spotifaux.NewMatchResult(3, s)
+	result.Shingles[0].Push(spotifaux.Winner{File: "a", Winner: 10, MinDist: 0.1})
+	result.Shingles[1].Push(spotifaux.Winner{File: "a", Winner: 30, MinDist: 0.9})
+	result.Shingles[2].Push(spotifaux.Winner{File: "b", Winner: 50, MinDist: 0.8})
+	fallback := spotifaux.NewMatchResult(3, s)
+	for i, c := range fallback.Shingles {
+		c.Push(spotifaux.Winner{File: "f", Winner: i, MinDist: 1.5})
+	}
+
+	within := s.Threshold(result)
+	winners := within.Winners()
+	assert.Equal(t, 10, winners[0].Winner)
+	assert.Equal(t, -1, winners[1].Winner)
+	assert.Equal(t, -1, winners[2].Winner)
+
+	for _, test := range []struct {
+		fallback spotifaux.Fallback
+		want     [][2]interface{}
+	}{
+		{spotifaux.FallbackSilence, [][2]interface{}{{"", -1}, {"", -1}}},
+		{spotifaux.FallbackPassthrough, [][2]interface{}{{"", 4}, {"", 8}}},
+		{spotifaux.FallbackHold, [][2]interface{}{{"a", 14}, {"a", 18}}},
+		{spotifaux.FallbackCorpus, [][2]interface{}{{"f", 1}, {"f", 2}}},
+	} {
+		s.Fallback = test.fallback
+		units := s.FallBack(winners, fallback)
+		assert.Equal(t, winners[0], units[0])
+		for i, want := range test.want {
+			unit := units[i+1]
+			assert.Equal(t, test.fallback.String(), unit.Fallback)
+			assert.Equal(t, 4*(i+1), unit.Query)
+			assert.Equal(t, want[0], unit.File, test.fallback.String())
+			assert.Equal(t, want[1], unit.Winner, test.fallback.String())
+		}
+	}
+}
+
+func Test_matchFallbackOnlyMatchesSilentShingles(t *testing.T) {
+	r := rand.New(rand.NewSource(44))
+	sources := testCorpus(t, r, 300, 200)
+	s := testSpotter(r, 23)
+	s.QueryHop = 2 // 11 shingles, the last running a frame past the end of the query
+
+	m := &spotifaux.CorpusMatcher{Workers: 2}
+	full, err := m.Match(sources, s)
+	assert.NoError(t, err)
+
+	units := full.Winners()
+	fallback, err := s.MatchFallback(context.Background(), m, sources, units, nil)
+	assert.NoError(t, err)
+	assert.Nil(t, fallback)
+
+	// two recipes, each with a silent unit
+	units[1].Winner = -1
+	units = append(units, full.Winners()...)
+	units[len(units)-1].Winner = -1
+	fallback, err = s.MatchFallback(context.Background(), m, sources, units, nil)
+	assert.NoError(t, err)
+	assert.Len(t, fallback.Shingles, 11)
+	assert.Equal(t, 2, fallback.QueryHop)
+	for i, c := range fallback.Shingles {
+		if i == 1 || i == 10 {
+			assert.Equal(t, full.Shingles[i].Winners(), c.Winners(), "shingle %d", i)
+		} else {
+			assert.Empty(t, c.Winners(), "shingle %d", i)
+		}
+	}
+
+	s.Fallback = spotifaux.FallbackCorpus
+	fallen := s.FallBack(units[:11], fallback)
+	assert.Equal(t, full.Shingles[1].Best().Winner, fallen[1].Winner)
+	assert.Equal(t, "corpus", fallen[1].Fallback)
+}
@@ -0,0 +1,435 @@
+package spotifaux
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const cacheIndexName = "index.json"
+
+// cacheTagName marks a directory as a feature cache, in the format of the Cache Directory Tagging
+// Specification, so that a cache is never opened in, and GC, Trim and Import never delete or add files
+// in, a directory of someone else's
+const cacheTagName = "CACHEDIR.TAG"
+const cacheTag = "Signature: 8a477f597d28d172789f06886806bc55\n" +
+	"# This file is created by spotifaux to mark its feature cache.\n"
+
+// FeatureCache stores dat files keyed by the content hash of their source audio and the
+// fingerprint of the extractor that produced them. Sources can live on read-only media,
+// duplicates are only extracted once, and since the entries do not depend on where the
+// audio lives, a cache directory can be copied (or merged with Import) to another machine.
+type FeatureCache struct {
+	Dir         string
+	MaxBytes    int64 // Trim evicts least recently used entries above this size, 0 for no limit
+	fingerprint string
+
+	mu    sync.Mutex
+	index map[string]string // source path, size and mod time to content hash, saves rehashing
+}
+
+// NewFeatureCache opens the cache in dir, creating it if dir is missing or empty, and refuses a
+// directory with other files in it that is not tagged as a cache
+
+func NewFeatureCache(dir string, e *FeatureExtractor) (*FeatureCache, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &FeatureCache{
+		Dir:         dir,
+		fingerprint: e.Fingerprint(),
+		index:       map[string]string{},
+	}
+	err = c.mark()
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(dir, cacheIndexName))
+	if err == nil {
+		err = json.Unmarshal(b, &c.index)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return c, nil
+}
+
+// mark tags Dir as a cache if it is not already, but only if it is empty or an untagged cache of an
+// older version, which has an index
+func (c *FeatureCache) mark() error {
+	tagName := filepath.Join(c.Dir, cacheTagName)
+	if _, err := os.Stat(tagName); err == nil {
+		return nil
+	}
+	files, err := ioutil.ReadDir(c.Dir)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(filepath.Join(c.Dir, cacheIndexName)); len(files) > 0 && err != nil {
+		return fmt.Errorf("%s is not a feature cache, as it has files in it but no %s", c.Dir, cacheTagName)
+	}
+	return ioutil.WriteFile(tagName, []byte(cacheTag), 0644)
+}
+
+// Path returns where the dat file for name in fsys is cached, whether or not it has been extracted yet
+func (c *FeatureCache) Path(fsys fs.FS, name string) (string, error) {
+	hash, err := c.contentHash(fsys, name)
+	if err != nil {
+		return "", err
+	}
+	return c.entryPath(hash), nil
+}
+
+func (c *FeatureCache) entryPath(hash string) string {
+	return filepath.Join(c.Dir, hash[:2], hash+"."+c.fingerprint+".dat")
+}
+
+// Dat returns the path of the dat file for name in fsys, extracting it with e on a miss
+func (c *FeatureCache) Dat(e *FeatureExtractor, fsys fs.FS, name string) (string, error) {
+	return c.dat(nil, e, fsys, name)
+}
+
+// Dats returns the paths of the dat files for names in fsys as Dat does, stopping with the error of ctx
+// once it is cancelled, and reporting the progress over all of them to progress if it is not nil
+func (c *FeatureCache) Dats(ctx context.Context, e *FeatureExtractor, fsys fs.FS, names []string,
+	progress ProgressFunc) ([]string, error) {
+
+	t := newTracker(ctx, progress, 0, len(names), 0)
+	datFileNames := make([]string, len(names))
+	for i, name := range names {
+		var err error
+		datFileNames[i], err = c.dat(t, e, fsys, name)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return datFileNames, nil
+}
+
+func (c *FeatureCache) dat(t *tracker, e *FeatureExtractor, fsys fs.FS, name string) (string, error) {
+	datFileName, err := c.Path(fsys, name)
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	if os.Chtimes(datFileName, now, now) == nil { // mod time orders entries for Trim
+		t.fileDone()
+		return datFileName, nil
+	}
+
+	err = os.MkdirAll(filepath.Dir(datFileName), 0755)
+	if err != nil {
+		return "", err
+	}
+
+	// extract beside the entry and rename, so a partial dat never appears in the cache
+	tmp, err := ioutil.TempFile(filepath.Dir(datFileName), "extract-*")
+	if err != nil {
+		return "", err
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+	defer os.Remove(PowerFileName(tmp.Name()))
+
+	err = e.extractSeriesOfVectors(t, fsys, name, tmp.Name())
+	if err != nil {
+		return "", err
+	}
+
+	// the dat appears last, as the entry is used whenever it exists
+	err = os.Rename(PowerFileName(tmp.Name()), PowerFileName(datFileName))
+	if err != nil {
+		return "", err
+	}
+	return datFileName, os.Rename(tmp.Name(), datFileName)
+}
+
+func (c *FeatureCache) contentHash(fsys fs.FS, name string) (string, error) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+
+	key, indexed := indexKey(fsys, name, fi)
+	if indexed {
+		c.mu.Lock()
+		hash, ok := c.index[key]
+		c.mu.Unlock()
+		if ok {
+			return hash, nil
+		}
+	}
+
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return "", err
+	}
+	hash := hex.EncodeToString(h.Sum(nil))
+
+	if indexed {
+		c.mu.Lock()
+		c.index[key] = hash
+		c.mu.Unlock()
+	}
+	return hash, nil
+}
+
+// indexKey names name in fsys in the index by its absolute path, so that sources of the same name in
+// different directories do not collide. Only a Corpus opened at a directory knows where it is, and
+// sources in any other file system are hashed every time.
+func indexKey(fsys fs.FS, name string, fi fs.FileInfo) (string, bool) {
+	c, ok := fsys.(*Corpus)
+	if !ok || c.Root == "" {
+		return "", false
+	}
+	p := filepath.Join(c.Root, filepath.FromSlash(name))
+	return fmt.Sprintf("%s\x00%d\x00%d", p, fi.Size(), fi.ModTime().UnixNano()), true
+}
+
+// SaveIndex persists the source to content hash index
+func (c *FeatureCache) SaveIndex() error {
+	c.mu.Lock()
+	b, err := json.Marshal(c.index)
+	c.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(c.Dir, cacheIndexName), b, 0644)
+}
+
+type cacheEntry struct {
+	path    string
+	size    int64 // of the dat and its power sidecar
+	modTime time.Time
+}
+
+// isEntry reports whether rel, a path relative to a cache directory, is named as entryPath names
+// entries, whatever the fingerprint
+func isEntry(rel string) bool {
+	parts := strings.Split(filepath.ToSlash(rel), "/")
+	if len(parts) != 2 {
+		return false
+	}
+	name := strings.Split(parts[1], ".")
+	if len(name) != 3 || name[2] != "dat" || len(name[0]) != 2*sha256.Size || !isHex(name[0]) || !isHex(name[1]) {
+		return false
+	}
+	return parts[0] == name[0][:2]
+}
+
+func isHex(s string) bool {
+	_, err := hex.DecodeString(s)
+	return err == nil && strings.ToLower(s) == s
+}
+
+// entries returns the cache entries in Dir, ignoring any other files
+func (c *FeatureCache) entries() ([]cacheEntry, error) {
+	var entries []cacheEntry
+	err := filepath.Walk(c.Dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(c.Dir, p)
+		if err != nil {
+			return err
+		}
+		if !fi.IsDir() && isEntry(rel) {
+			size := fi.Size()
+			if pfi, err := os.Stat(PowerFileName(p)); err == nil {
+				size += pfi.Size()
+			}
+			entries = append(entries, cacheEntry{p, size, fi.ModTime()})
+		}
+		return nil
+	})
+	return entries, err
+}
+
+// remove deletes the dat before its sidecar, so a dat is never left without its powers
+func (entry cacheEntry) remove() error {
+	err := os.Remove(entry.path)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(PowerFileName(entry.path))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// Size returns the number of bytes used by cache entries
+func (c *FeatureCache) Size() (int64, error) {
+	entries, err := c.entries()
+	if err != nil {
+		return 0, err
+	}
+	size := int64(0)
+	for _, entry := range entries {
+		size += entry.size
+	}
+	return size, nil
+}
+
+// GC removes every entry not in keep (paths returned by Path or Dat), including entries
+// written by other extractor versions, and returns the number of bytes freed. Files in Dir that are
+// not named as entries are left alone.
+func (c *FeatureCache) GC(keep []string) (int64, error) {
+	referenced := map[string]bool{}
+	for _, p := range keep {
+		referenced[filepath.Clean(p)] = true
+	}
+
+	entries, err := c.entries()
+	if err != nil {
+		return 0, err
+	}
+
+	freed := int64(0)
+	for _, entry := range entries {
+		if !referenced[entry.path] {
+			err = entry.remove()
+			if err != nil {
+				return freed, err
+			}
+			freed += entry.size
+		}
+	}
+	return freed, c.pruneIndex()
+}
+
+// Trim evicts least recently used entries until the cache fits in MaxBytes and returns the number of bytes freed
+func (c *FeatureCache) Trim() (int64, error) {
+	if c.MaxBytes <= 0 {
+		return 0, nil
+	}
+
+	entries, err := c.entries()
+	if err != nil {
+		return 0, err
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].modTime.Before(entries[j].modTime)
+	})
+
+	size := int64(0)
+	for _, entry := range entries {
+		size += entry.size
+	}
+
+	freed := int64(0)
+	for _, entry := range entries {
+		if size-freed <= c.MaxBytes {
+			break
+		}
+		err = entry.remove()
+		if err != nil {
+			return freed, err
+		}
+		freed += entry.size
+	}
+	return freed, c.pruneIndex()
+}
+
+// pruneIndex forgets sources with no remaining entry for the current fingerprint
+func (c *FeatureCache) pruneIndex() error {
+	c.mu.Lock()
+	for key, hash := range c.index {
+		_, err := os.Stat(c.entryPath(hash))
+		if os.IsNotExist(err) {
+			delete(c.index, key)
+		}
+	}
+	c.mu.Unlock()
+	return c.SaveIndex()
+}
+
+// Import copies the entries of another cache directory that are missing from this one. An entry
+// without its power sidecar, as left by an interrupted copy, is skipped.
+func (c *FeatureCache) Import(dir string) (int, error) {
+	imported := 0
+	err := filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() || !isEntry(rel) {
+			return nil
+		}
+
+		dst := filepath.Join(c.Dir, rel)
+		if _, err := os.Stat(dst); err == nil {
+			return nil
+		}
+
+		if _, err := os.Stat(PowerFileName(p)); err != nil {
+			return nil
+		}
+		err = copyFile(PowerFileName(p), PowerFileName(dst))
+		if err != nil {
+			return err
+		}
+		err = copyFile(p, dst)
+		if err != nil {
+			return err
+		}
+		imported++
+		return nil
+	})
+	return imported, err
+}
+
+func copyFile(src, dst string) error {
+	err := os.MkdirAll(filepath.Dir(dst), 0755)
+	if err != nil {
+		return err
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	tmp, err := ioutil.TempFile(filepath.Dir(dst), "import-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = io.Copy(tmp, in)
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), dst)
+}
@@ -0,0 +1,133 @@
+package spotifaux_test
+
+import (
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"spotifaux"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+// writeTestEntry stands in for an extracted entry of the cache at datFileName, with its powers if
+// withPowers is set
+func writeTestEntry(t testing.TB, datFileName string, frames int, withPowers bool) {
+	assert.NoError(t, os.MkdirAll(filepath.Dir(datFileName), 0755))
+	dat := make([][]uint8, frames)
+	for i := range dat {
+		dat[i] = make([]uint8, testCqtN)
+	}
+	writeTestDat(t, datFileName, dat)
+	if withPowers {
+		assert.NoError(t, spotifaux.WritePowers(spotifaux.PowerFileName(datFileName), make([]float64, frames)))
+	}
+}
+
+func Test_featureCacheGCTrimAndImport(t *testing.T) {
+	e := spotifaux.NewFeatureExtractor(spotifaux.SAMPLE_RATE)
+	dir := filepath.Join(t.TempDir(), "cache")
+	c, err := spotifaux.NewFeatureCache(dir, e)
+	assert.NoError(t, err)
+
+	fsys := fstest.MapFS{
+		"a.wav": {Data: []byte("a")},
+		"b.wav": {Data: []byte("b")},
+		"c.wav": {Data: []byte("c")},
+	}
+	var paths []string
+	for i, name := range []string{"a.wav", "b.wav", "c.wav"} {
+		p, err := c.Path(fsys, name)
+		assert.NoError(t, err)
+		writeTestEntry(t, p, 100, true)
+		at := time.Now().Add(time.Duration(i-3) * time.Hour) // a used least recently
+		assert.NoError(t, os.Chtimes(p, at, at))
+		paths = append(paths, p)
+	}
+	entrySize := int64(8 + 100*testCqtN)
+	if fi, err := os.Stat(spotifaux.PowerFileName(paths[0])); assert.NoError(t, err) {
+		entrySize += fi.Size()
+	}
+
+	// files that are not entries of this cache are never touched
+	strangers := []string{filepath.Join(dir, "notes.dat"), filepath.Join(dir, "ab", "take.dat")}
+	for _, p := range strangers {
+		writeTestEntry(t, p, 10, false)
+	}
+	other := filepath.Join(filepath.Dir(paths[1]), filepath.Base(paths[1])[:64]+".0123456789abcdef.dat")
+	writeTestEntry(t, other, 10, false)
+
+	size, err := c.Size()
+	assert.NoError(t, err)
+	assert.Equal(t, 3*entrySize+8+10*testCqtN, size)
+
+	freed, err := c.GC(paths[1:])
+	assert.NoError(t, err)
+	assert.Equal(t, entrySize+8+10*testCqtN, freed)
+	assert.NoFileExists(t, paths[0])
+	assert.NoFileExists(t, spotifaux.PowerFileName(paths[0]))
+	assert.NoFileExists(t, other)
+	for _, p := range append(strangers, paths[1:]...) {
+		assert.FileExists(t, p)
+	}
+
+	c.MaxBytes = entrySize
+	freed, err = c.Trim()
+	assert.NoError(t, err)
+	assert.Equal(t, entrySize, freed)
+	assert.NoFileExists(t, paths[1])
+	assert.FileExists(t, paths[2])
+
+	// another cache with an entry this one lacks, one it has, one without powers and a stranger
+	from := t.TempDir()
+	for i, p := range paths {
+		rel, err := filepath.Rel(dir, p)
+		assert.NoError(t, err)
+		writeTestEntry(t, filepath.Join(from, rel), 5, i != 1)
+	}
+	writeTestEntry(t, filepath.Join(from, "notes.dat"), 5, false)
+	imported, err := c.Import(from)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, imported)
+	assert.FileExists(t, paths[0])
+	assert.FileExists(t, spotifaux.PowerFileName(paths[0]))
+	assert.NoFileExists(t, paths[1])
+	assert.NoFileExists(t, spotifaux.PowerFileName(paths[1]))
+	if fi, err := os.Stat(paths[2]); assert.NoError(t, err) {
+		assert.Equal(t, int64(8+100*testCqtN), fi.Size()) // kept its own
+	}
+	imported, err = c.Import(from)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, imported)
+}
+
+func Test_featureCacheRefusesUntaggedDirectory(t *testing.T) {
+	e := spotifaux.NewFeatureExtractor(spotifaux.SAMPLE_RATE)
+	dir := t.TempDir()
+	mine := filepath.Join(dir, "mine.dat")
+	writeTestEntry(t, mine, 10, false)
+
+	_, err := spotifaux.NewFeatureCache(dir, e)
+	assert.Error(t, err)
+	assert.FileExists(t, mine)
+	assert.NoFileExists(t, filepath.Join(dir, "CACHEDIR.TAG"))
+}
+
+func Test_featureCacheTellsApartSourcesInDifferentDirectories(t *testing.T) {
+	e := spotifaux.NewFeatureExtractor(spotifaux.SAMPLE_RATE)
+	c, err := spotifaux.NewFeatureCache(filepath.Join(t.TempDir(), "cache"), e)
+	assert.NoError(t, err)
+
+	// the same name, size and mod time, but not the same audio
+	var paths []string
+	at := time.Now().Add(-time.Hour)
+	for _, data := range []string{"a", "b"} {
+		dir := t.TempDir()
+		writeTestFiles(t, dir, map[string][]byte{"take.wav": []byte(data)})
+		assert.NoError(t, os.Chtimes(filepath.Join(dir, "take.wav"), at, at))
+		p, err := c.Path(spotifaux.OpenCorpus(dir), "take.wav")
+		assert.NoError(t, err)
+		paths = append(paths, p)
+	}
+	assert.NotEqual(t, paths[0], paths[1])
+}
@@ -0,0 +1,288 @@
+package spotifaux
+
+import (
+	"archive/zip"
+	"bufio"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+)
+
+// FeatureSource is a feature file and the name of the audio it was extracted from
+type FeatureSource struct {
+	Name        string
+	DatFileName string
+}
+
+// FrameTime is the start time in seconds of a feature frame
+func FrameTime(frame int) float64 {
+	return float64(frame*Hop) / SAMPLE_RATE
+}
+
+func sourceFrames(sources []FeatureSource, cqtN int) ([]int, error) {
+	frames := make([]int, len(sources))
+	for i, source := range sources {
+		dr, err := NewDatReader(source.DatFileName, cqtN)
+		if err != nil {
+			return nil, err
+		}
+		frames[i] = dr.Frames
+		dr.Close()
+	}
+	return frames, nil
+}
+
+// sourceWidth returns the number of features per frame, which an export needs all sources to share
+func sourceWidth(sources []FeatureSource, cqtN int) (int, error) {
+	width := cqtN
+	for i, source := range sources {
+		dr, err := NewDatReader(source.DatFileName, cqtN)
+		if err != nil {
+			return 0, err
+		}
+		dr.Close()
+		if i == 0 {
+			width = dr.Width
+		} else if dr.Width != width {
+			return 0, fmt.Errorf("%s has %d features per frame and %s %d, so they cannot be exported together",
+				source.DatFileName, dr.Width, sources[0].DatFileName, width)
+		}
+	}
+	return width, nil
+}
+
+// eachFrame calls fn with every frame of every source in order
+func eachFrame(sources []FeatureSource, cqtN int, fn func(source, frame int, features []float64) error) error {
+	for i, source := range sources {
+		dr, err := NewDatReader(source.DatFileName, cqtN)
+		if err != nil {
+			return err
+		}
+		for frame := 0; frame < dr.Frames; frame++ {
+			features, err := dr.Dat()
+			if err == nil {
+				err = fn(i, frame, features)
+			}
+			if err != nil {
+				dr.Close()
+				return err
+			}
+		}
+		err = dr.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ExportNpy writes all frames as a structured array with fields source (index into sources),
+// time (seconds) and features, loadable with numpy.load
+func ExportNpy(w io.Writer, sources []FeatureSource, cqtN int) error {
+	frames, err := sourceFrames(sources, cqtN)
+	if err != nil {
+		return err
+	}
+	width, err := sourceWidth(sources, cqtN)
+	if err != nil {
+		return err
+	}
+	total := 0
+	for _, n := range frames {
+		total += n
+	}
+
+	bw := bufio.NewWriter(w)
+	descr := fmt.Sprintf("[('source', '<i4'), ('time', '<f8'), ('features', '<f4', (%d,))]", width)
+	err = writeNpyHeader(bw, descr, []int{total})
+	if err != nil {
+		return err
+	}
+
+	err = eachFrame(sources, cqtN, func(source, frame int, features []float64) error {
+		err := binary.Write(bw, binary.LittleEndian, int32(source))
+		if err == nil {
+			err = binary.Write(bw, binary.LittleEndian, FrameTime(frame))
+		}
+		if err == nil {
+			err = writeFloat32s(bw, features)
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// ExportNpz writes the arrays features (frames, features per frame), time (frames,), source (frames,) and
+// sources (the names that source indexes), loadable with numpy.load
+func ExportNpz(w io.Writer, sources []FeatureSource, cqtN int) error {
+	frames, err := sourceFrames(sources, cqtN)
+	if err != nil {
+		return err
+	}
+	width, err := sourceWidth(sources, cqtN)
+	if err != nil {
+		return err
+	}
+	total := 0
+	maxName := 1
+	for i, n := range frames {
+		total += n
+		if runes := len([]rune(sources[i].Name)); runes > maxName {
+			maxName = runes
+		}
+	}
+
+	zw := zip.NewWriter(w)
+
+	f, err := zw.Create("features.npy")
+	if err != nil {
+		return err
+	}
+	err = writeNpyHeader(f, "'<f4'", []int{total, width})
+	if err != nil {
+		return err
+	}
+	err = eachFrame(sources, cqtN, func(source, frame int, features []float64) error {
+		return writeFloat32s(f, features)
+	})
+	if err != nil {
+		return err
+	}
+
+	f, err = zw.Create("time.npy")
+	if err != nil {
+		return err
+	}
+	err = writeNpyHeader(f, "'<f8'", []int{total})
+	if err != nil {
+		return err
+	}
+	for _, n := range frames {
+		for frame := 0; frame < n; frame++ {
+			err = binary.Write(f, binary.LittleEndian, FrameTime(frame))
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	f, err = zw.Create("source.npy")
+	if err != nil {
+		return err
+	}
+	err = writeNpyHeader(f, "'<i4'", []int{total})
+	if err != nil {
+		return err
+	}
+	for i, n := range frames {
+		for frame := 0; frame < n; frame++ {
+			err = binary.Write(f, binary.LittleEndian, int32(i))
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	f, err = zw.Create("sources.npy")
+	if err != nil {
+		return err
+	}
+	err = writeNpyHeader(f, fmt.Sprintf("'<U%d'", maxName), []int{len(sources)})
+	if err != nil {
+		return err
+	}
+	for _, source := range sources {
+		name := make([]uint32, maxName) // UTF-32, zero padded
+		for i, r := range []rune(source.Name) {
+			name[i] = uint32(r)
+		}
+		err = binary.Write(f, binary.LittleEndian, name)
+		if err != nil {
+			return err
+		}
+	}
+
+	return zw.Close()
+}
+
+func writeFloat32s(w io.Writer, features []float64) error {
+	b := make([]float32, len(features))
+	for i, feature := range features {
+		b[i] = float32(feature)
+	}
+	return binary.Write(w, binary.LittleEndian, b)
+}
+
+// ExportCSV writes a row of source, frame, time and features per frame
+func ExportCSV(w io.Writer, sources []FeatureSource, cqtN int) error {
+	width, err := sourceWidth(sources, cqtN)
+	if err != nil {
+		return err
+	}
+	cw := csv.NewWriter(w)
+
+	header := []string{"source", "frame", "time"}
+	for i := 0; i < width; i++ {
+		header = append(header, "c"+strconv.Itoa(i))
+	}
+	err = cw.Write(header)
+	if err != nil {
+		return err
+	}
+
+	err = eachFrame(sources, cqtN, func(source, frame int, features []float64) error {
+		row := []string{sources[source].Name, strconv.Itoa(frame), strconv.FormatFloat(FrameTime(frame), 'f', -1, 64)}
+		for _, feature := range features {
+			row = append(row, strconv.FormatFloat(feature, 'g', -1, 64))
+		}
+		return cw.Write(row)
+	})
+	if err != nil {
+		return err
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
+
+type jsonFrame struct {
+	Source   string        `json:"source"`
+	Frame    int           `json:"frame"`
+	Time     float64       `json:"time"`
+	Features []jsonFeature `json:"features"`
+}
+
+// jsonFeature encodes NaN and infinite features, which JSON cannot represent, as null
+type jsonFeature float64
+
+func (f jsonFeature) MarshalJSON() ([]byte, error) {
+	if math.IsNaN(float64(f)) || math.IsInf(float64(f), 0) {
+		return []byte("null"), nil
+	}
+	return strconv.AppendFloat(nil, float64(f), 'g', -1, 64), nil
+}
+
+// ExportJSONL writes a JSON object per frame, one per line
+func ExportJSONL(w io.Writer, sources []FeatureSource, cqtN int) error {
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+
+	err := eachFrame(sources, cqtN, func(source, frame int, features []float64) error {
+		jsonFeatures := make([]jsonFeature, len(features))
+		for i, feature := range features {
+			jsonFeatures[i] = jsonFeature(feature)
+		}
+		return enc.Encode(jsonFrame{sources[source].Name, frame, FrameTime(frame), jsonFeatures})
+	})
+	if err != nil {
+		return err
+	}
+	return bw.Flush()
+}
@@ -0,0 +1,143 @@
+package spotifaux_test
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/binary"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"spotifaux"
+	"strings"
+	"testing"
+)
+
+// writeTestNpy writes frames as a float64 .npy array of (frames, features)
+func writeTestNpy(t testing.TB, fileName string, frames [][]float64) {
+	var b bytes.Buffer
+	assert.NoError(t, spotifaux.WriteNpyHeader(&b, "'<f8'", []int{len(frames), len(frames[0])}))
+	for _, frame := range frames {
+		assert.NoError(t, binary.Write(&b, binary.LittleEndian, frame))
+	}
+	assert.NoError(t, os.WriteFile(fileName, b.Bytes(), 0644))
+}
+
+func readTestFrames(t testing.TB, datFileName string) [][]float64 {
+	dr, err := spotifaux.NewDatReader(datFileName, testCqtN)
+	assert.NoError(t, err)
+	defer dr.Close()
+	frames := make([][]float64, dr.Frames)
+	for i := range frames {
+		frames[i], err = dr.Dat()
+		assert.NoError(t, err)
+	}
+	return frames
+}
+
+func Test_exportNpzReadsBack(t *testing.T) {
+	r := rand.New(rand.NewSource(29))
+	sources := testCorpus(t, r, 30, 20, 1)[:2]
+	var want [][]float64
+	for _, source := range sources {
+		want = append(want, readTestFrames(t, source.DatFileName)...)
+	}
+
+	var b bytes.Buffer
+	assert.NoError(t, spotifaux.ExportNpz(&b, sources, testCqtN))
+	zr, err := zip.NewReader(bytes.NewReader(b.Bytes()), int64(b.Len()))
+	assert.NoError(t, err)
+	arrays := map[string][]byte{}
+	for _, f := range zr.File {
+		rc, err := f.Open()
+		assert.NoError(t, err)
+		arrays[f.Name], err = io.ReadAll(rc)
+		assert.NoError(t, err)
+		rc.Close()
+	}
+
+	// features.npy is itself a feature file
+	npyFileName := filepath.Join(t.TempDir(), "features.npy")
+	assert.NoError(t, os.WriteFile(npyFileName, arrays["features.npy"], 0644))
+	got := readTestFrames(t, npyFileName)
+	assert.Len(t, got, 50)
+	for i := range want {
+		assert.InDeltaSlice(t, want[i], got[i], 1e-6)
+	}
+
+	r2 := bytes.NewReader(arrays["source.npy"])
+	descr, shape, err := spotifaux.ReadNpyHeader(r2)
+	assert.NoError(t, err)
+	assert.Equal(t, "<i4", descr)
+	assert.Equal(t, []int{50}, shape)
+	ids := make([]int32, 50)
+	assert.NoError(t, binary.Read(r2, binary.LittleEndian, ids))
+	assert.Equal(t, int32(0), ids[29])
+	assert.Equal(t, int32(1), ids[30])
+
+	r2 = bytes.NewReader(arrays["time.npy"])
+	_, _, err = spotifaux.ReadNpyHeader(r2)
+	assert.NoError(t, err)
+	times := make([]float64, 50)
+	assert.NoError(t, binary.Read(r2, binary.LittleEndian, times))
+	assert.Equal(t, spotifaux.FrameTime(29), times[29])
+	assert.Equal(t, 0.0, times[30])
+
+	// the structured .npy has the same records
+	b.Reset()
+	assert.NoError(t, spotifaux.ExportNpy(&b, sources, testCqtN))
+	var headerLen uint16
+	assert.Equal(t, "\x93NUMPY\x01\x00", string(b.Next(8)))
+	assert.NoError(t, binary.Read(&b, binary.LittleEndian, &headerLen))
+	header := string(b.Next(int(headerLen)))
+	assert.Contains(t, header, "('features', '<f4', (24,))")
+	assert.Contains(t, header, "'shape': (50,)")
+	for i := range want {
+		var record struct {
+			Source   int32
+			Time     float64
+			Features [testCqtN]float32
+		}
+		assert.NoError(t, binary.Read(&b, binary.LittleEndian, &record))
+		assert.Equal(t, int32(i/30), record.Source)
+		for j, v := range record.Features {
+			assert.InDelta(t, want[i][j], v, 1e-6)
+		}
+	}
+}
+
+func Test_npyFeaturesOfAnyWidth(t *testing.T) {
+	r := rand.New(rand.NewSource(30))
+	frames := make([][]float64, 200)
+	for i := range frames {
+		frames[i] = make([]float64, 10)
+		for j := range frames[i] {
+			frames[i][j] = r.NormFloat64()
+		}
+	}
+	dir := t.TempDir()
+	npyFileName := filepath.Join(dir, "external.npy")
+	writeTestNpy(t, npyFileName, frames)
+
+	s := &spotifaux.SoundSpotter{ChosenFeatures: []int{1, 2, 3, 5, 7}, CqtN: testCqtN, ShingleSize: 4, TopK: 1}
+	s.InShingles = frames[120:128]
+	result, err := spotifaux.Match("external", npyFileName, s)
+	assert.NoError(t, err)
+	assert.Equal(t, 120, result.Winners()[0].Winner)
+	assert.Equal(t, 124, result.Winners()[1].Winner)
+
+	s.ChosenFeatures = []int{1, 12}
+	_, err = spotifaux.Match("external", npyFileName, s)
+	assert.Error(t, err)
+
+	var b bytes.Buffer
+	sources := []spotifaux.FeatureSource{{Name: "external", DatFileName: npyFileName}}
+	assert.NoError(t, spotifaux.ExportCSV(&b, sources, testCqtN))
+	header := strings.SplitN(b.String(), "\n", 2)[0]
+	assert.Equal(t, "source,frame,time,c0,c1,c2,c3,c4,c5,c6,c7,c8,c9", header)
+
+	// an export needs every source to have the same features
+	sources = append(sources, testCorpus(t, r, 10, 1)[0])
+	assert.Error(t, spotifaux.ExportNpz(&b, sources, testCqtN))
+}
@@ -1,15 +1,25 @@
 package spotifaux
 
 import (
+	"context"
+	"crypto/sha256"
 	"encoding/binary"
+	"encoding/hex"
+	"fmt"
 	"github.com/runningwild/go-fftw/fftw"
+	"io/fs"
 	"math"
 	"os"
 )
 
 const CQ_ENV_THRESH = 0.001
 
+// featureVersion changes whenever extraction or the dat layout does, invalidating cached dats
+const featureVersion = 2
+
 type FeatureExtractor struct {
+	Transpose  int // semitones the constant-Q spectrum is shifted up by before the cepstral transform
+	sampleRate int
 	bpoN       int       // constant-Q bands per octave (user)
 	CqtN       int       // number of constant-Q coefficients (automatic)
 	CQT        []float64 // constant-Q transform coefficients
@@ -33,6 +43,7 @@ func NewFeatureExtractor(sampleRate int) *FeatureExtractor {
 	fftComplex := fftw.NewArray(fftOutN)
 
 	e := &FeatureExtractor{
+		sampleRate: sampleRate,
 		bpoN:       12,
 		fftN:       fftN,
 		fftOutN:    fftOutN,
@@ -49,6 +60,17 @@ func NewFeatureExtractor(sampleRate int) *FeatureExtractor {
 	return e
 }
 
+// Fingerprint identifies the extraction parameters, so features from different extractors are never mixed
+func (e *FeatureExtractor) Fingerprint() string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%d %d %d %d %d %d %d %g", featureVersion, e.sampleRate, e.fftN, WindowLength, Hop, e.bpoN, e.CqtN,
+		CQ_ENV_THRESH)
+	if e.Transpose != 0 {
+		fmt.Fprintf(h, " transpose %d", e.Transpose)
+	}
+	return hex.EncodeToString(h.Sum(nil))[:16]
+}
+
 // FFT Hamming window
 func (e *FeatureExtractor) makeHammingWin() {
 	e.hammingWin = make([]float64, WindowLength)
@@ -135,39 +157,79 @@ func (e *FeatureExtractor) makeDCT() {
 	}
 }
 
-// extract feature vectors from multichannel audio float buffer (allocate new vector memory)
-func (e *FeatureExtractor) ExtractSeriesOfVectors(wavFileName, datFileName string) error {
+// extract feature vectors from any decodable audio file (allocate new vector memory), and the power
+// of each frame to PowerFileName(datFileName)
+func (e *FeatureExtractor) ExtractSeriesOfVectors(fsys fs.FS, audioFileName, datFileName string) error {
+	return e.ExtractSeriesOfVectorsContext(context.Background(), fsys, audioFileName, datFileName, nil)
+}
+
+// ExtractSeriesOfVectorsContext is ExtractSeriesOfVectors stopping with the error of ctx once it is
+// cancelled, before writing anything, and reporting its progress to progress if it is not nil
+func (e *FeatureExtractor) ExtractSeriesOfVectorsContext(ctx context.Context, fsys fs.FS, audioFileName,
+	datFileName string, progress ProgressFunc) error {
+
+	return e.extractSeriesOfVectors(newTracker(ctx, progress, 0, 1, 0), fsys, audioFileName, datFileName)
+}
 
-	sf, err := NewSoundFile(wavFileName)
+func (e *FeatureExtractor) extractSeriesOfVectors(t *tracker, fsys fs.FS, audioFileName, datFileName string) error {
+	err := t.advance(0, nil)
 	if err != nil {
 		return err
 	}
-	defer sf.Close()
 
-	frames := int(math.Ceil(float64(sf.Frames) / (float64(Hop))))
+	a, err := OpenAudio(fsys, audioFileName)
+	if err != nil {
+		return err
+	}
+	defer a.Close()
 
-	dbBuf := make([]float64, sf.Frames)
-	_, err = sf.ReadFrames(dbBuf) // TODO: support calling readFrames multiple times
+	dbBuf, err := a.ReadAll()
 	if err != nil {
 		return err
 	}
 
+	frames := int(math.Ceil(float64(len(dbBuf)) / (float64(Hop))))
+	t.addTotalFrames(frames)
+
 	features := make([][]uint8, frames)
+	powers := make([]float64, frames)
 	for i := 0; i < frames; i++ {
 		features[i] = make([]uint8, e.CqtN)
-		buf := make([]float64, WindowLength)
-		for j := 0; j < WindowLength; j++ {
-			val := 0.0
-			if i*Hop+j < len(dbBuf) {
-				val = dbBuf[i*Hop+j] // extract from left channel only
+		e.extractFrame(dbBuf, i, features[i])
+		powers[i] = framePower(dbBuf, i)
+
+		if (i+1)%progressBlock == 0 || i == frames-1 {
+			err = t.advance(i%progressBlock+1, nil)
+			if err != nil {
+				return err
 			}
-			buf[j] = val
 		}
+	}
 
-		e.extractVector(buf, features[i])
+	err = writePowers(PowerFileName(datFileName), powers)
+	if err != nil {
+		return err
+	}
+	err = writeFeatures(datFileName, frames, features)
+	if err != nil {
+		return err
+	}
+	t.fileDone()
+	return nil
+}
+
+// extract the feature vector of frame i of a whole mono file
+func (e *FeatureExtractor) extractFrame(dbBuf []float64, i int, outputFeatures []uint8) {
+	buf := make([]float64, WindowLength)
+	for j := 0; j < WindowLength; j++ {
+		val := 0.0
+		if i*Hop+j < len(dbBuf) {
+			val = dbBuf[i*Hop+j]
+		}
+		buf[j] = val
 	}
 
-	return writeFeatures(datFileName, frames, features)
+	e.extractVector(buf, outputFeatures)
 }
 
 // extract feature vectors from MONO input buffer
@@ -210,6 +272,9 @@ func (e *FeatureExtractor) computeMFCC(outs1 []uint8) {
 	for i := 0; i < e.CqtN; i++ {
 		cqtOut[i] = math.Log10(cqtOut[i])
 	}
+	if e.Transpose != 0 {
+		cqtOut = e.transposeBins(cqtOut)
+	}
 
 	maxOuts1 := math.SmallestNonzeroFloat64
 	minOuts1 := math.MaxFloat64
@@ -239,6 +304,23 @@ func (e *FeatureExtractor) computeMFCC(outs1 []uint8) {
 	}
 }
 
+// transposeBins shifts a constant-Q spectrum up by e.Transpose semitones, repeating the edge bin into
+// the bins shifted in from outside the spectrum
+func (e *FeatureExtractor) transposeBins(cqtOut []float64) []float64 {
+	shift := e.Transpose * e.bpoN / 12
+	shifted := make([]float64, len(cqtOut))
+	for i := range shifted {
+		j := i - shift
+		if j < 0 {
+			j = 0
+		} else if j >= len(cqtOut) {
+			j = len(cqtOut) - 1
+		}
+		shifted[i] = cqtOut[j]
+	}
+	return shifted
+}
+
 func writeFeatures(datFileName string, frames int, features [][]uint8) error {
 
 	f, err := os.Create(datFileName)
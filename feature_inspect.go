@@ -0,0 +1,205 @@
+package spotifaux
+
+import (
+	"fmt"
+	"io/fs"
+	"math"
+	"os"
+	"strings"
+)
+
+// DatInfo summarizes the contents of a feature file
+type DatInfo struct {
+	Frames       int       // frame count in the header
+	CqtN         int       // coefficients per frame
+	Size         int64     // actual file size
+	ExpectedSize int64     // file size implied by the header
+	Min          []float64 // of each coefficient over the frames without NaN, NaN if there are none
+	Max          []float64
+	Mean         []float64
+	SilentFrames int       // frames with every coefficient equal, which is what digital silence extracts to
+	NaNFrames    int       // frames with a NaN coefficient (only possible in imported .npy), left out of the above
+	Energy       []float64 // squared norm of each frame, as seen by Match, NaN for NaN frames
+}
+
+func InspectDat(datFileName string, cqtN int) (*DatInfo, error) {
+	dr, err := NewDatReader(datFileName, cqtN)
+	if err != nil {
+		return nil, err
+	}
+	defer dr.Close()
+	cqtN = dr.Width
+
+	fi, err := os.Stat(datFileName)
+	if err != nil {
+		return nil, err
+	}
+
+	info := &DatInfo{
+		Frames:       dr.Frames,
+		CqtN:         cqtN,
+		Size:         fi.Size(),
+		ExpectedSize: dr.Size(),
+		Min:          make([]float64, cqtN),
+		Max:          make([]float64, cqtN),
+		Mean:         make([]float64, cqtN),
+	}
+	for i := 0; i < cqtN; i++ {
+		info.Min[i] = math.Inf(1)
+		info.Max[i] = math.Inf(-1)
+	}
+
+	counted := 0
+	for frame := 0; frame < dr.Frames; frame++ {
+		features, err := dr.Dat()
+		if err != nil {
+			break // truncated, reported by Consistent
+		}
+
+		nan := false
+		for _, feature := range features {
+			nan = nan || math.IsNaN(feature)
+		}
+		if nan {
+			info.NaNFrames++
+			info.Energy = append(info.Energy, math.NaN())
+			continue
+		}
+
+		energy := 0.0
+		silent := true
+		for i, feature := range features {
+			info.Min[i] = math.Min(info.Min[i], feature)
+			info.Max[i] = math.Max(info.Max[i], feature)
+			info.Mean[i] += feature
+			energy += feature * feature
+			silent = silent && feature == features[0]
+		}
+		if silent {
+			info.SilentFrames++
+		}
+		info.Energy = append(info.Energy, energy)
+		counted++
+	}
+
+	for i := 0; i < cqtN; i++ {
+		if counted == 0 {
+			info.Min[i], info.Max[i], info.Mean[i] = math.NaN(), math.NaN(), math.NaN()
+		} else {
+			info.Mean[i] /= float64(counted)
+		}
+	}
+
+	return info, nil
+}
+
+// Consistent reports whether the file size agrees with the frame count in the header
+func (info *DatInfo) Consistent() bool {
+	return info.Size == info.ExpectedSize
+}
+
+var sparks = []rune("▁▂▃▄▅▆▇█")
+
+// Sparkline draws values as a line of at most width block characters, averaging values that share a
+// character. NaN values are left out, and a character with only NaN values is a space.
+func Sparkline(values []float64, width int) string {
+	if len(values) == 0 || width <= 0 {
+		return ""
+	}
+	if width > len(values) {
+		width = len(values)
+	}
+
+	buckets := make([]float64, width)
+	lo, hi := math.Inf(1), math.Inf(-1)
+	for b := range buckets {
+		from, to := b*len(values)/width, (b+1)*len(values)/width
+		n := 0
+		for _, v := range values[from:to] {
+			if !math.IsNaN(v) {
+				buckets[b] += v
+				n++
+			}
+		}
+		buckets[b] /= float64(n) // NaN if n is 0
+		if n > 0 {
+			lo = math.Min(lo, buckets[b])
+			hi = math.Max(hi, buckets[b])
+		}
+	}
+
+	var sb strings.Builder
+	for _, v := range buckets {
+		if math.IsNaN(v) {
+			sb.WriteRune(' ')
+			continue
+		}
+		level := 0
+		if hi > lo {
+			level = int((v - lo) / (hi - lo) * float64(len(sparks)-1))
+		}
+		sb.WriteRune(sparks[level])
+	}
+	return sb.String()
+}
+
+// VerifyResult compares stored features against features re-extracted from the source audio
+type VerifyResult struct {
+	ExpectedFrames int   // frames the source audio extracts to
+	Checked        []int // frames that were re-extracted
+	Mismatched     []int // frames that differ by more than one quantization step
+	MaxDiff        float64
+}
+
+// VerifyDat re-extracts samples frames spread evenly over audioFileName and compares them to datFileName
+func (e *FeatureExtractor) VerifyDat(fsys fs.FS, audioFileName, datFileName string, samples int) (*VerifyResult, error) {
+	a, err := OpenAudio(fsys, audioFileName)
+	if err != nil {
+		return nil, err
+	}
+	dbBuf, err := a.ReadAll()
+	a.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	dr, err := NewDatReader(datFileName, e.CqtN)
+	if err != nil {
+		return nil, err
+	}
+	defer dr.Close()
+
+	result := &VerifyResult{
+		ExpectedFrames: int(math.Ceil(float64(len(dbBuf)) / (float64(Hop)))),
+	}
+
+	if samples > dr.Frames {
+		samples = dr.Frames
+	}
+	extracted := make([]uint8, e.CqtN)
+	for s := 0; s < samples; s++ {
+		frame := s * dr.Frames / samples
+		err = dr.Seek(frame)
+		if err != nil {
+			return nil, err
+		}
+		stored, err := dr.Dat()
+		if err != nil {
+			return nil, fmt.Errorf("%s frame %d: %v", datFileName, frame, err)
+		}
+
+		e.extractFrame(dbBuf, frame, extracted)
+		result.Checked = append(result.Checked, frame)
+
+		diff := 0.0
+		for i, b := range extracted {
+			diff = math.Max(diff, math.Abs(stored[i]-dequantize(b)))
+		}
+		if diff > 1.0/255+1e-9 || math.IsNaN(diff) {
+			result.Mismatched = append(result.Mismatched, frame)
+		}
+		result.MaxDiff = math.Max(result.MaxDiff, diff)
+	}
+
+	return result, nil
+}
@@ -0,0 +1,111 @@
+package spotifaux_test
+
+import (
+	"github.com/stretchr/testify/assert"
+	"math"
+	"os"
+	"path/filepath"
+	"spotifaux"
+	"testing"
+)
+
+func Test_inspectDat(t *testing.T) {
+	dir := t.TempDir()
+	frames := make([][]uint8, 4)
+	for i := range frames {
+		frames[i] = make([]uint8, testCqtN)
+		for j := range frames[i] {
+			frames[i][j] = uint8(128 + i*j)
+		}
+	}
+	datFileName := filepath.Join(dir, "a.dat")
+	writeTestDat(t, datFileName, frames)
+
+	info, err := spotifaux.InspectDat(datFileName, testCqtN)
+	assert.NoError(t, err)
+	assert.True(t, info.Consistent())
+	assert.Equal(t, 4, info.Frames)
+	assert.Equal(t, 1, info.SilentFrames) // frame 0 is all 128
+	assert.Equal(t, 0, info.NaNFrames)
+	assert.Len(t, info.Energy, 4)
+	assert.Equal(t, 0.0, info.Energy[0])
+	assert.InDelta(t, 0.0, info.Min[2], 1e-9)
+	assert.InDelta(t, 6.0/255, info.Max[2], 1e-9)
+	assert.InDelta(t, 3.0/255, info.Mean[2], 1e-9)
+
+	assert.NoError(t, os.Truncate(datFileName, 8+3*testCqtN+5))
+	info, err = spotifaux.InspectDat(datFileName, testCqtN)
+	assert.NoError(t, err)
+	assert.False(t, info.Consistent())
+	assert.Len(t, info.Energy, 3)
+
+	writeTestDat(t, datFileName, nil)
+	info, err = spotifaux.InspectDat(datFileName, testCqtN)
+	assert.NoError(t, err)
+	assert.True(t, info.Consistent())
+	assert.True(t, math.IsNaN(info.Mean[0]))
+	assert.Equal(t, "", spotifaux.Sparkline(info.Energy, 10))
+}
+
+func Test_inspectDatLeavesOutNaNFrames(t *testing.T) {
+	nan := math.NaN()
+	npyFileName := filepath.Join(t.TempDir(), "external.npy")
+	writeTestNpy(t, npyFileName, [][]float64{{1, 2}, {nan, 5}, {3, 0}})
+
+	info, err := spotifaux.InspectDat(npyFileName, testCqtN)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, info.CqtN)
+	assert.Equal(t, 1, info.NaNFrames)
+	assert.Equal(t, []float64{1, 0}, info.Min)
+	assert.Equal(t, []float64{3, 2}, info.Max)
+	assert.Equal(t, []float64{2, 1}, info.Mean)
+	assert.Equal(t, 5.0, info.Energy[0])
+	assert.True(t, math.IsNaN(info.Energy[1]))
+	assert.Equal(t, 9.0, info.Energy[2])
+	assert.Equal(t, "▁ █", spotifaux.Sparkline(info.Energy, 3))
+
+	writeTestNpy(t, npyFileName, [][]float64{{nan, 1}, {2, nan}})
+	info, err = spotifaux.InspectDat(npyFileName, testCqtN)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, info.NaNFrames)
+	for i := 0; i < 2; i++ {
+		assert.True(t, math.IsNaN(info.Min[i]))
+		assert.True(t, math.IsNaN(info.Max[i]))
+		assert.True(t, math.IsNaN(info.Mean[i]))
+	}
+	assert.Equal(t, "  ", spotifaux.Sparkline(info.Energy, 2))
+}
+
+func Test_sparkline(t *testing.T) {
+	assert.Equal(t, "▁▂▃▄▅▆▇█", spotifaux.Sparkline([]float64{0, 1, 2, 3, 4, 5, 6, 7}, 8))
+	assert.Equal(t, "▁▃▅█", spotifaux.Sparkline([]float64{0, 1, 2, 3, 4, 5, 6, 7}, 4))
+	assert.Equal(t, "▁▁", spotifaux.Sparkline([]float64{4, 4}, 10))
+	assert.Equal(t, "", spotifaux.Sparkline([]float64{1}, 0))
+}
+
+func Test_verifyDat(t *testing.T) {
+	dir := t.TempDir()
+	tone := make([]float64, 20*spotifaux.Hop)
+	for i := range tone {
+		tone[i] = 0.5 * math.Sin(2*math.Pi*440*float64(i)/spotifaux.SAMPLE_RATE)
+	}
+	writeTestWav(t, filepath.Join(dir, "tone.wav"), tone, spotifaux.SAMPLE_RATE)
+
+	e := spotifaux.NewFeatureExtractor(spotifaux.SAMPLE_RATE)
+	datFileName := filepath.Join(dir, "tone.dat")
+	assert.NoError(t, e.ExtractSeriesOfVectors(os.DirFS(dir), "tone.wav", datFileName))
+
+	result, err := e.VerifyDat(os.DirFS(dir), "tone.wav", datFileName, 5)
+	assert.NoError(t, err)
+	assert.Equal(t, 20, result.ExpectedFrames)
+	assert.Equal(t, []int{0, 4, 8, 12, 16}, result.Checked)
+	assert.Empty(t, result.Mismatched)
+
+	b, err := os.ReadFile(datFileName)
+	assert.NoError(t, err)
+	b[8+8*e.CqtN+3] += 10
+	assert.NoError(t, os.WriteFile(datFileName, b, 0644))
+	result, err = e.VerifyDat(os.DirFS(dir), "tone.wav", datFileName, 5)
+	assert.NoError(t, err)
+	assert.Equal(t, []int{8}, result.Mismatched)
+}
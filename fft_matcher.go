@@ -0,0 +1,176 @@
+package spotifaux
+
+import (
+	"github.com/runningwild/go-fftw/fftw"
+	"math/bits"
+)
+
+func fftCostPerPosition(x, shingleSize, features int) float64 {
+	n := fftLength(shingleSize)
+	step := float64(n - shingleSize + 1)
+	transform := fftCost * float64(n*bits.Len(uint(n-1)))
+	half := float64(n/2 + 1)
+
+	// two real columns share each transform, both forwards over the database and back per query shingle
+	forward := float64((features+1)/2) * transform
+	multiply := float64(x*features) * half * spectrumMulCost
+	backward := float64((x+1)/2) * transform
+	return (forward + multiply + backward) / step
+}
+
+// fftLength is the transform length for a shingle size. Longer transforms share each forward
+// transform between more positions, but cost more per position in the spectrum products.
+func fftLength(shingleSize int) int {
+	n := 1 << bits.Len(uint(8*shingleSize-1))
+	if n < 32 {
+		n = 32
+	}
+	return n
+}
+
+// fftCorrelator correlates each feature of a query shingle with the same feature of the database by
+// FFT, adding up the spectrum products of all features before transforming back. Each transform of
+// length n yields the cross terms of n-ShingleSize+1 positions.
+//
+// The features are real, so pairs of columns are transformed together as the real and imaginary
+// parts of one signal, and only the non-negative frequencies of their spectra are kept.
+type fftCorrelator struct {
+	shingleSize int
+	features    int
+	n           int
+	half        int // non-negative frequencies, n/2 + 1
+	step        int // positions per transform, n - shingleSize + 1
+
+	qSpectra  [][]complex128 // conjugate spectra of query shingle columns, ins*features + f
+	dbSpectra [][]complex128 // spectra of the database columns of the current transform
+	acc       [2][]complex128
+
+	in, out           *fftw.Array
+	forward, backward *fftw.Plan
+}
+
+func newFFTCorrelator(q [][]float64, shingleSize, features int) *fftCorrelator {
+	n := fftLength(shingleSize)
+	c := &fftCorrelator{
+		shingleSize: shingleSize,
+		features:    features,
+		n:           n,
+		half:        n/2 + 1,
+		step:        n - shingleSize + 1,
+		in:          fftw.NewArray(n),
+		out:         fftw.NewArray(n),
+	}
+	c.forward = fftw.NewPlan(c.in, c.out, fftw.Forward, fftw.Estimate)
+	c.backward = fftw.NewPlan(c.in, c.out, fftw.Backward, fftw.Estimate)
+	c.acc[0] = make([]complex128, c.half)
+	c.acc[1] = make([]complex128, c.half)
+
+	x := len(q) / shingleSize
+	c.qSpectra = make([][]complex128, x*features)
+	for i := range c.qSpectra {
+		c.qSpectra[i] = make([]complex128, c.half)
+	}
+	for ins := 0; ins < x; ins++ {
+		c.transform(q[ins*shingleSize:(ins+1)*shingleSize], c.qSpectra[ins*features:(ins+1)*features])
+		for _, spectrum := range c.qSpectra[ins*features : (ins+1)*features] {
+			for k := range spectrum {
+				spectrum[k] = complex(real(spectrum[k]), -imag(spectrum[k]))
+			}
+		}
+	}
+
+	c.dbSpectra = make([][]complex128, features)
+	for i := range c.dbSpectra {
+		c.dbSpectra[i] = make([]complex128, c.half)
+	}
+	return c
+}
+
+// transform writes the spectrum of each feature column of frames, zero padded to n, to spectra[f]
+func (c *fftCorrelator) transform(frames [][]float64, spectra [][]complex128) {
+	for f := 0; f < c.features; f += 2 {
+		j := 0
+		for ; j < len(frames); j++ {
+			im := 0.0
+			if f+1 < c.features {
+				im = frames[j][f+1]
+			}
+			c.in.Elems[j] = complex(frames[j][f], im)
+		}
+		for ; j < c.n; j++ {
+			c.in.Elems[j] = 0
+		}
+		c.forward.Execute()
+
+		// separate the spectra of the real and imaginary parts using conjugate symmetry
+		z := c.out.Elems
+		for k := 0; k < c.half; k++ {
+			zk, zc := z[k], z[(c.n-k)%c.n]
+			zc = complex(real(zc), -imag(zc))
+			spectra[f][k] = (zk + zc) / 2
+			if f+1 < c.features {
+				d := (zk - zc) / 2
+				spectra[f+1][k] = complex(imag(d), -real(d))
+			}
+		}
+	}
+}
+
+func (c *fftCorrelator) correlate(db [][]float64, positions int, DD [][]float64) {
+	x := len(DD)
+	for p0 := 0; p0 < positions; p0 += c.step {
+		end := p0 + c.n
+		if end > len(db) {
+			end = len(db)
+		}
+		c.transform(db[p0:end], c.dbSpectra)
+
+		count := c.step
+		if p0+count > positions {
+			count = positions - p0
+		}
+
+		for ins := 0; ins < x; ins += 2 {
+			for pair := 0; pair < 2; pair++ {
+				acc := c.acc[pair]
+				for k := range acc {
+					acc[k] = 0
+				}
+				if ins+pair >= x {
+					continue
+				}
+				qSpectra := c.qSpectra[(ins+pair)*c.features : (ins+pair+1)*c.features]
+				for f, dbSpectrum := range c.dbSpectra {
+					qSpectrum := qSpectra[f]
+					for k, v := range dbSpectrum {
+						acc[k] += v * qSpectrum[k]
+					}
+				}
+			}
+
+			// both correlations are real, so one inverse transform gives them as real and imaginary parts
+			a, b := c.acc[0], c.acc[1]
+			for k := 0; k < c.half; k++ {
+				c.in.Elems[k] = a[k] + complex(-imag(b[k]), real(b[k]))
+			}
+			for k := c.half; k < c.n; k++ {
+				ak, bk := a[c.n-k], b[c.n-k]
+				c.in.Elems[k] = complex(real(ak), -imag(ak)) + complex(imag(bk), real(bk))
+			}
+			c.backward.Execute()
+
+			scale := 1 / float64(c.n)
+			for p := 0; p < count; p++ {
+				DD[ins][p0+p] = real(c.out.Elems[p]) * scale
+				if ins+1 < x {
+					DD[ins+1][p0+p] = imag(c.out.Elems[p]) * scale
+				}
+			}
+		}
+	}
+}
+
+func (c *fftCorrelator) close() {
+	c.forward.Destroy()
+	c.backward.Destroy()
+}
@@ -0,0 +1,49 @@
+// Package kernel holds the integer inner loops of the quantized matcher. It is kept apart from
+// package spotifaux, which uses cgo and so cannot contain Go assembly.
+//
+// On amd64 DotRows is written in SSE2 assembly. Elsewhere, or built with the purego tag, it is the
+// portable Go loop, which works on the same padded layout. In particular there is no NEON kernel
+// yet, so arm64 runs the quantized backend unaccelerated.
+package kernel
+
+// Lanes is the number of int16 values per SIMD register. Vectors passed to the kernels are padded
+// with zeros to a multiple of Lanes.
+const Lanes = 8
+
+// Stride is the padded length of a vector of n values
+func Stride(n int) int {
+	return (n + Lanes - 1) / Lanes * Lanes
+}
+
+// DotRows sets out[j] to the dot product of q with row j of db, the rows being len(q) apart.
+// len(q) must be a non-zero multiple of Lanes and db must hold len(out) rows.
+func DotRows(q, db []int16, out []int32) {
+	if len(q) == 0 || len(q)%Lanes != 0 || len(db) < len(out)*len(q) {
+		panic("kernel: DotRows vectors not padded to Lanes")
+	}
+	dotRows(q, db, out)
+}
+
+// Dot is the dot product of two vectors of the same length
+func Dot(a, b []int16) int32 {
+	b = b[:len(a)]
+	var s0, s1, s2, s3 int32
+	i := 0
+	for ; i+4 <= len(a); i += 4 {
+		s0 += int32(a[i]) * int32(b[i])
+		s1 += int32(a[i+1]) * int32(b[i+1])
+		s2 += int32(a[i+2]) * int32(b[i+2])
+		s3 += int32(a[i+3]) * int32(b[i+3])
+	}
+	for ; i < len(a); i++ {
+		s0 += int32(a[i]) * int32(b[i])
+	}
+	return s0 + s1 + s2 + s3
+}
+
+func dotRowsGeneric(q, db []int16, out []int32) {
+	stride := len(q)
+	for j := range out {
+		out[j] = Dot(q, db[j*stride:(j+1)*stride])
+	}
+}
@@ -0,0 +1,9 @@
+//go:build !purego
+// +build !purego
+
+package kernel
+
+// dotRows multiplies Lanes pairs at a time with SSE2 PMADDWD, which every amd64 processor has
+//
+//go:noescape
+func dotRows(q, db []int16, out []int32)
@@ -0,0 +1,77 @@
+//go:build !purego
+// +build !purego
+
+#include "textflag.h"
+
+// func dotRows(q, db []int16, out []int32)
+//
+// Two rows are multiplied at a time, so their multiply-adds overlap and they share the reduction of
+// the partial sums, and a last odd row is done on its own.
+TEXT ·dotRows(SB), NOSPLIT, $0-72
+	MOVQ q_base+0(FP), SI
+	MOVQ q_len+8(FP), CX
+	MOVQ db_base+24(FP), DI
+	MOVQ out_base+48(FP), DX
+	MOVQ out_len+56(FP), R8
+	SHLQ $1, CX // row length in bytes
+	XORQ R9, R9
+
+pair:
+	LEAQ 2(R9), AX
+	CMPQ AX, R8
+	JG   single
+	PXOR X0, X0
+	PXOR X3, X3
+	LEAQ (DI)(CX*1), R11
+	XORQ R10, R10
+
+pairLanes:
+	MOVOU   (SI)(R10*1), X1
+	MOVOU   (DI)(R10*1), X2
+	MOVOU   (R11)(R10*1), X4
+	PMADDWL X1, X2
+	PMADDWL X1, X4
+	PADDL   X2, X0
+	PADDL   X4, X3
+	ADDQ    $16, R10
+	CMPQ    R10, CX
+	JLT     pairLanes
+
+	// add the four partial sums of each row, leaving the two totals in the low quadword
+	MOVO       X0, X1
+	PUNPCKLQDQ X3, X0
+	PUNPCKHQDQ X3, X1
+	PADDL      X1, X0
+	PSHUFD     $0xb1, X0, X1
+	PADDL      X1, X0
+	PSHUFD     $0x08, X0, X0
+	MOVQ       X0, (DX)(R9*4)
+
+	LEAQ (DI)(CX*2), DI
+	ADDQ $2, R9
+	JMP  pair
+
+single:
+	CMPQ R9, R8
+	JGE  done
+	PXOR X0, X0
+	XORQ R10, R10
+
+lanes:
+	MOVOU   (SI)(R10*1), X1
+	MOVOU   (DI)(R10*1), X2
+	PMADDWL X2, X1
+	PADDL   X1, X0
+	ADDQ    $16, R10
+	CMPQ    R10, CX
+	JLT     lanes
+
+	PSHUFD $0x4e, X0, X1
+	PADDL  X1, X0
+	PSHUFD $0xb1, X0, X1
+	PADDL  X1, X0
+	MOVQ   X0, AX
+	MOVL   AX, (DX)(R9*4)
+
+done:
+	RET
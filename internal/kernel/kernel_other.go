@@ -0,0 +1,8 @@
+//go:build !amd64 || purego
+// +build !amd64 purego
+
+package kernel
+
+func dotRows(q, db []int16, out []int32) {
+	dotRowsGeneric(q, db, out)
+}
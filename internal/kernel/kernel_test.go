@@ -0,0 +1,31 @@
+package kernel
+
+import (
+	"github.com/stretchr/testify/assert"
+	"math/rand"
+	"testing"
+)
+
+func Test_dotRowsAgreesWithGeneric(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for _, n := range []int{1, 7, 8, 18, 24, 33} {
+		stride := Stride(n)
+		q := make([]int16, stride)
+		db := make([]int16, 51*stride)
+		for i := 0; i < n; i++ {
+			q[i] = int16(r.Intn(256) - 128)
+		}
+		for j := 0; j < 51; j++ {
+			for i := 0; i < n; i++ {
+				db[j*stride+i] = int16(r.Intn(256) - 128)
+			}
+		}
+
+		want := make([]int32, 51)
+		dotRowsGeneric(q, db, want)
+		got := make([]int32, 51)
+		DotRows(q, db, got)
+		assert.Equal(t, want, got, n)
+		assert.Equal(t, want[3], Dot(q[:n], db[3*stride:3*stride+n]))
+	}
+}
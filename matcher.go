@@ -1,6 +1,7 @@
 package spotifaux
 
 import (
+	"context"
 	"math"
 )
 
@@ -15,19 +16,390 @@ import (
 // Substantially Modified: Michael A. Casey, August 24th - 27th 2007
 // Factored out dependency on SoundSpotter class, August 8th - 9th 2009
 // Added power features for threshold tests
-func Match(wavFileName, datFileName string, s *SoundSpotter) ([]Winner, error) {
+//
+// Keeps the s.TopK best candidates per query shingle
+func Match(fileName, datFileName string, s *SoundSpotter) (*MatchResult, error) {
+	return matchRange(nil, fileName, datFileName, s, 0, -1)
+}
+
+// MatchContext is Match stopping with the error of ctx once it is cancelled, and reporting its progress
+// to progress if it is not nil
+func MatchContext(ctx context.Context, fileName, datFileName string, s *SoundSpotter,
+	progress ProgressFunc) (*MatchResult, error) {
+
+	return (&CorpusMatcher{Workers: 1}).MatchContext(ctx, []FeatureSource{{Name: fileName, DatFileName: datFileName}},
+		s, progress)
+}
+
+// matchBlock is the number of database positions correlated at a time, which bounds the per-frame
+// dot product matrix to queryFrames x (matchBlock + ShingleSize - 1)
+const matchBlock = 1024
+
+// MatchBackend selects how Match computes the cross terms between query and database shingles
+type MatchBackend int
+
+const (
+	BackendAuto      MatchBackend = iota // whichever backend is estimated to be faster for the sizes
+	BackendDirect                        // per-frame dot products summed along diagonals
+	BackendFFT                           // per-feature cross-correlation by FFT over blocks of the database
+	BackendQuantized                     // BackendDirect in integer arithmetic on the stored bytes
+)
+
+func (b MatchBackend) String() string {
+	switch b {
+	case BackendDirect:
+		return "direct"
+	case BackendFFT:
+		return "fft"
+	case BackendQuantized:
+		return "quantized"
+	}
+	return "auto"
+}
+
+// Relative costs of the inner loops, measured per database position. A direct multiply-add costs 1,
+// a quantized one quantizedCost, one complex multiply-add of two spectra about 4, and an FFT of
+// length n about fftCost*n*log2(n). quantizedCost is how much more slowly BenchmarkMatchLongQueryQuantized
+// than BenchmarkMatchQuantized grows with the query against BenchmarkMatchLongQuery and BenchmarkMatch
+// (about 16 to 83 ms/op against 59 to 504), since all of them pay the same cost of reading the dat.
+const (
+	spectrumMulCost = 4.0
+	fftCost         = 2.5
+	quantizedCost   = 0.15
+)
+
+// matchBackend resolves BackendAuto for x query shingles of the given number of features, where
+// quantized is whether both query and database features are exactly representable as bytes
+func (s *SoundSpotter) matchBackend(x, features int, quantized bool) MatchBackend {
+	if s.Backend != BackendAuto {
+		return s.Backend
+	}
+	direct := directCostPerPosition(x, s.ShingleSize, features)
+	backend := BackendDirect
+	if quantized {
+		direct *= quantizedCost
+		backend = BackendQuantized
+	}
+	if fftCostPerPosition(x, s.ShingleSize, features) < direct {
+		return BackendFFT
+	}
+	return backend
+}
+
+func directCostPerPosition(x, shingleSize, features int) float64 {
+	// a dot product per query frame, then ShingleSize additions per query shingle
+	return float64(x*shingleSize*features + x*shingleSize)
+}
+
+// matchRange matches database positions [from, to), to < 0 meaning the end of the file, under each
+// transform of the database that s asks for
+func matchRange(t *tracker, fileName, datFileName string, s *SoundSpotter, from, to int) (*MatchResult, error) {
+	var result *MatchResult
+	for _, transform := range s.transforms() {
+		v := *s
+		v.transform = transform
+		if transform.Transpose != 0 {
+			v.InShingles = s.InTransposed[transform.Transpose]
+		}
+		if len(v.InShingles) > 0 {
+			if err := checkChosen(s.ChosenFeatures, "the query", len(v.InShingles[0])); err != nil {
+				return nil, err
+			}
+		}
+		r, err := matchTransformed(t, fileName, datFileName, &v, from, to)
+		if err != nil {
+			return nil, err
+		}
+		r.record(transform)
+		if result == nil {
+			result = r
+		} else {
+			result.Merge(r)
+		}
+	}
+	return result, nil
+}
+
+// matchTransformed matches the query against the database under s.transform.
+//
+// Rather than correlating every shingle pair from scratch, the cross terms of a whole block come from
+// a crossCorrelator, and database shingle norms are sliding sums of frame norms, computed with SeriesSum.
+func matchTransformed(t *tracker, fileName, datFileName string, s *SoundSpotter, from, to int) (*MatchResult, error) {
+
+	dr, err := NewDatReader(datFileName, s.CqtN)
+	if err != nil {
+		return nil, err
+	}
+	defer dr.Close()
+	if err = dr.checkChosen(s.ChosenFeatures); err != nil {
+		return nil, err
+	}
+
+	if to < 0 || to > dr.Frames {
+		to = dr.Frames
+	}
+	err = dr.Seek(from)
+	if err != nil {
+		return nil, err
+	}
+
+	sc, err := newScorer(s)
+	if err != nil {
+		return nil, err
+	}
+	err = sc.load(datFileName)
+	if err != nil {
+		return nil, err
+	}
+	if s.warps() {
+		return matchDTW(t, fileName, dr, s, sc, from, to)
+	}
+	if sc.nd == nil {
+		return matchFull(t, fileName, dr, s, sc, from, to)
+	}
+
+	x := queryShingles(s)
+	quantized := dr.Quantized() && queryQuantized(s) && sc.transform == nil
+	backend := s.matchBackend(x, len(s.ChosenFeatures), quantized)
+	if s.PruneFeatures == 0 && backend == BackendQuantized {
+		return matchQuantized(t, fileName, dr, s, sc, from, to)
+	}
+
+	result := NewMatchResult(x, s)
+
+	q := queryFrames(s, sc.features)
+	qN := make([]float64, x)
+	for ins := 0; ins < x; ins++ {
+		for muxi := 0; muxi < s.ShingleSize; muxi++ {
+			qN[ins] += dot(q[ins*s.ShingleSize+muxi], q[ins*s.ShingleSize+muxi])
+		}
+		qN[ins] = math.Sqrt(qN[ins])
+	}
+
+	var cc crossCorrelator
+	var pr *pruner
+	if s.PruneFeatures > 0 {
+		pr = newPruner(q, s)
+	} else if backend == BackendFFT {
+		cc = newFFTCorrelator(q, s.ShingleSize, len(s.ChosenFeatures))
+	} else {
+		cc = newDirectCorrelator(q, s.ShingleSize)
+	}
+	if cc != nil {
+		defer cc.close()
+	}
+
+	window := matchBlock + s.ShingleSize - 1
+	db := make([][]float64, 0, window) // database frames from b0
+	sk := make([]float64, window)
+	var DD [][]float64
+	if cc != nil {
+		DD = make([][]float64, x)
+	}
+	for i := range DD {
+		DD[i] = make([]float64, matchBlock)
+	}
+
+	for b0 := from; b0 < to; b0 += matchBlock {
+		b1 := b0 + matchBlock
+		if b1 > to {
+			b1 = to
+		}
+		end := b1 + s.ShingleSize - 1
+		if end > dr.Frames {
+			end = dr.Frames
+		}
+
+		// keep the frames shared with the previous block's window and read the rest
+		if len(db) > 0 {
+			db = append(db[:0], db[matchBlock:]...)
+		}
+		for j := b0 + len(db); j < end; j++ {
+			features, err := dr.Dat()
+			if err != nil {
+				return nil, err
+			}
+			db = append(db, sc.features(features))
+		}
+		w := len(db)
+
+		for j := 0; j < w; j++ {
+			sk[j] = dot(db[j], db[j])
+		}
+		SeriesSum(sk[:w], s.ShingleSize)
+		for j := 0; j < w; j++ {
+			sk[j] = math.Sqrt(sk[j])
+		}
+
+		result.Pairs += x * (b1 - b0)
+		if pr != nil {
+			result.Pruned += pr.match(fileName, db, b0, b1-b0, qN, sk, sc, result)
+		} else {
+			cc.correlate(db, b1-b0, DD)
+
+			for ins := 0; ins < x; ins++ {
+				candidates := result.Shingles[ins]
+				for p := 0; p < b1-b0; p++ {
+					dRadius := sc.score(ins, b0+p, DD[ins][p], qN[ins], sk[p])
 
-	x := len(s.InShingles) / s.ShingleSize
-	if len(s.InShingles)%s.ShingleSize > 0 {
-		x++
+					// Perform min-dist search
+					if dRadius < candidates.Worst() || candidates.Len() == 0 {
+						candidates.Push(Winner{
+							File:    fileName,
+							MinDist: dRadius,
+							Winner:  b0 + p,
+						})
+					}
+				}
+			}
+		}
+
+		err = t.advance(b1-b0, result)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// crossCorrelator computes the cross term of every query shingle with the database shingles starting
+// at the first positions frames of db, DD[ins][p] = sum over muxi of q[ins*ShingleSize+muxi] . db[p+muxi],
+// where shingles running off the end of db are summed over the frames there are
+type crossCorrelator interface {
+	correlate(db [][]float64, positions int, DD [][]float64)
+	close()
+}
+
+// directCorrelator multiplies each query frame with each database frame once, and a shingle's cross
+// term is the sum of ShingleSize of these products along a diagonal
+type directCorrelator struct {
+	q           [][]float64
+	shingleSize int
+	D           [][]float64 // per-frame dot products, query frame x database frame
+}
+
+func newDirectCorrelator(q [][]float64, shingleSize int) *directCorrelator {
+	D := make([][]float64, len(q))
+	for i := range D {
+		D[i] = make([]float64, matchBlock+shingleSize-1)
+	}
+	return &directCorrelator{q: q, shingleSize: shingleSize, D: D}
+}
+
+func (c *directCorrelator) correlate(db [][]float64, positions int, DD [][]float64) {
+	w := len(db)
+	for qi := range c.q {
+		for j := 0; j < w; j++ {
+			c.D[qi][j] = dot(c.q[qi], db[j])
+		}
+	}
+
+	for ins := range DD {
+		for p := 0; p < positions; p++ {
+			sum := 0.0
+			for muxi := 0; muxi < c.shingleSize && p+muxi < w; muxi++ {
+				sum += c.D[ins*c.shingleSize+muxi][p+muxi]
+			}
+			DD[ins][p] = sum
+		}
 	}
-	fileWinners := make([]Winner, x)
+}
+
+func (c *directCorrelator) close() {}
+
+// chosenFeatures copies the chosen features of a frame into a contiguous vector
+func chosenFeatures(frame []float64, chosen []int) []float64 {
+	out := make([]float64, len(chosen))
+	for i, qp := range chosen {
+		out[i] = frame[qp]
+	}
+	return out
+}
+
+// dot uses independent partial sums, so consecutive multiply-adds do not wait on each other
+func dot(a, b []float64) float64 {
+	b = b[:len(a)]
+	var s0, s1, s2, s3 float64
+	i := 0
+	for ; i+4 <= len(a); i += 4 {
+		s0 += a[i] * b[i]
+		s1 += a[i+1] * b[i+1]
+		s2 += a[i+2] * b[i+2]
+		s3 += a[i+3] * b[i+3]
+	}
+	for ; i < len(a); i++ {
+		s0 += a[i] * b[i]
+	}
+	return (s0 + s1) + (s2 + s3)
+}
+
+// matchFull computes a distance that does not factor in full at each position
+func matchFull(t *tracker, fileName string, dr *datReader, s *SoundSpotter, sc *scorer,
+	from, to int) (*MatchResult, error) {
+
+	x := queryShingles(s)
+	result := NewMatchResult(x, s)
+
+	q := queryFrames(s, sc.features)
+
+	db := make([][]float64, 0, s.ShingleSize) // the database shingle at dpp
+	for j := from; j < from+s.ShingleSize && j < dr.Frames; j++ {
+		features, err := dr.Dat()
+		if err != nil {
+			return nil, err
+		}
+		db = append(db, sc.features(features))
+	}
+
+	reported := from
+	for dpp := from; dpp < to; dpp++ {
+		dbShingle := Shingle{Frames: db, Power: sc.power(dpp)}
+		for ins := 0; ins < x; ins++ {
+			dRadius := sc.d.Distance(sc.shingle(q, ins), dbShingle)
+
+			// Perform min-dist search
+			if dRadius < result.Shingles[ins].Worst() || result.Shingles[ins].Len() == 0 {
+				result.Shingles[ins].Push(Winner{
+					File:    fileName,
+					MinDist: dRadius,
+					Winner:  dpp,
+				})
+			}
+		}
+
+		db = append(db[:0], db[1:]...)
+		if dpp+s.ShingleSize < dr.Frames {
+			features, err := dr.Dat()
+			if err != nil {
+				return nil, err
+			}
+			db = append(db, sc.features(features))
+		}
+
+		if dpp+1-reported == progressBlock || dpp == to-1 {
+			err := t.advance(dpp+1-reported, result)
+			if err != nil {
+				return nil, err
+			}
+			reported = dpp + 1
+		}
+	}
+	result.Pairs = x * (to - from)
+	return result, nil
+}
+
+// matchBruteForce correlates every query shingle with every database shingle in full,
+// the reference for matchTransformed
+func matchBruteForce(fileName, datFileName string, s *SoundSpotter, from, to int) (*MatchResult, error) {
+
+	x := queryShingles(s)
+	result := NewMatchResult(x, s)
 
 	qN := make([]float64, x)
 	for ins := 0; ins < x; ins++ {
 		for muxi := 0; muxi < s.ShingleSize; muxi++ {
 			for _, qp := range s.ChosenFeatures {
-				feature := s.InShingles[ins*s.ShingleSize+muxi][qp]
+				feature := queryFrame(s, ins, muxi)[qp]
 				qN[ins] += feature * feature
 			}
 		}
@@ -38,10 +410,22 @@ func Match(wavFileName, datFileName string, s *SoundSpotter) ([]Winner, error) {
 	if err != nil {
 		return nil, err
 	}
+	defer dr.Close()
+	if err = dr.checkChosen(s.ChosenFeatures); err != nil {
+		return nil, err
+	}
+
+	if to < 0 || to > dr.Frames {
+		to = dr.Frames
+	}
+	err = dr.Seek(from)
+	if err != nil {
+		return nil, err
+	}
 
 	front := 0
 	dbShingles := make([][]float64, s.ShingleSize)
-	for dpp := 0; dpp < s.ShingleSize; dpp++ {
+	for dpp := 0; dpp < s.ShingleSize && from+dpp < dr.Frames; dpp++ {
 		dbShingles[dpp], err = dr.Dat()
 		if err != nil {
 			return nil, err
@@ -49,10 +433,10 @@ func Match(wavFileName, datFileName string, s *SoundSpotter) ([]Winner, error) {
 	}
 
 	// Make Correlation matrix entry for this frame against entire source database
-	for dpp := 0; dpp < dr.Frames; dpp++ {
+	for dpp := from; dpp < to; dpp++ {
 		for ins := 0; ins < x; ins++ {
 
-			sk := 0.0 // TODO: more efficient with a SeriesSum
+			sk := 0.0
 			DD := 0.0
 			for muxi := 0; muxi < s.ShingleSize; muxi++ {
 				m := (front + muxi) % s.ShingleSize
@@ -61,7 +445,7 @@ func Match(wavFileName, datFileName string, s *SoundSpotter) ([]Winner, error) {
 				}
 				for _, qp := range s.ChosenFeatures {
 					sk += dbShingles[m][qp] * dbShingles[m][qp]
-					DD += s.InShingles[ins*s.ShingleSize+muxi][qp] * dbShingles[m][qp]
+					DD += queryFrame(s, ins, muxi)[qp] * dbShingles[m][qp]
 				}
 			}
 			sk = math.Sqrt(sk)
@@ -70,12 +454,12 @@ func Match(wavFileName, datFileName string, s *SoundSpotter) ([]Winner, error) {
 			dRadius := math.Abs(2 - 2*DD/(qN[ins]*sk))
 
 			// Perform min-dist search
-			if (fileWinners[ins] == Winner{}) || dRadius < fileWinners[ins].MinDist {
-				fileWinners[ins] = Winner{
-					File:    wavFileName,
+			if dRadius < result.Shingles[ins].Worst() || result.Shingles[ins].Len() == 0 {
+				result.Shingles[ins].Push(Winner{
+					File:    fileName,
 					MinDist: dRadius,
 					Winner:  dpp,
-				}
+				})
 			}
 		}
 
@@ -89,5 +473,53 @@ func Match(wavFileName, datFileName string, s *SoundSpotter) ([]Winner, error) {
 		}
 		front = (front + 1) % s.ShingleSize
 	}
-	return fileWinners, nil
+	result.Pairs = x * (to - from)
+	return result, nil
+}
+
+// queryHop is the number of frames from the start of one query shingle to the next
+func (s *SoundSpotter) queryHop() int {
+	if s.QueryHop <= 0 {
+		return s.ShingleSize
+	}
+	return s.QueryHop
+}
+
+// queryShingles is the number of query shingles in s.InShingles, the last running past the end of the
+// query unless the shingles fit exactly
+func queryShingles(s *SoundSpotter) int {
+	if len(s.InShingles) == 0 {
+		return 0
+	}
+	if len(s.InShingles) <= s.ShingleSize {
+		return 1
+	}
+	hop := s.queryHop()
+	return (len(s.InShingles)-s.ShingleSize+hop-1)/hop + 1
+}
+
+// queryFrame returns frame muxi of query shingle ins, silence past the end of the query. A reversed
+// database unit is matched by the query shingle read backwards.
+func queryFrame(s *SoundSpotter, ins, muxi int) []float64 {
+	if s.transform.Reversed {
+		muxi = s.ShingleSize - 1 - muxi
+	}
+	i := ins*s.queryHop() + muxi
+	if i >= len(s.InShingles) {
+		return make([]float64, len(s.InShingles[0]))
+	}
+	return s.InShingles[i]
+}
+
+// queryFrames maps every frame of every query shingle with f, query shingle ins becoming frames
+// ins*ShingleSize to (ins+1)*ShingleSize of the result. Overlapping shingles repeat the frames they share.
+func queryFrames(s *SoundSpotter, f func([]float64) []float64) [][]float64 {
+	x := queryShingles(s)
+	q := make([][]float64, x*s.ShingleSize)
+	for ins := 0; ins < x; ins++ {
+		for muxi := 0; muxi < s.ShingleSize; muxi++ {
+			q[ins*s.ShingleSize+muxi] = f(queryFrame(s, ins, muxi))
+		}
+	}
+	return q
 }
@@ -0,0 +1,104 @@
+package spotifaux_test
+
+import (
+	"github.com/stretchr/testify/assert"
+	"math/rand"
+	"spotifaux"
+	"testing"
+)
+
+func Test_matchAgreesWithBruteForce(t *testing.T) {
+	r := rand.New(rand.NewSource(2))
+	sources := testCorpus(t, r, 2500, 2)
+	s := testSpotter(r, 40)
+	s.TopK = 5
+
+	configs := []struct {
+		backend spotifaux.MatchBackend
+		prune   int
+		hop     int
+	}{{spotifaux.BackendDirect, 0, 0}, {spotifaux.BackendFFT, 0, 0}, {spotifaux.BackendQuantized, 0, 0},
+		{spotifaux.BackendDirect, 2, 0}, {spotifaux.BackendDirect, 0, 3}, {spotifaux.BackendFFT, 0, 3},
+		{spotifaux.BackendQuantized, 0, 3}, {spotifaux.BackendDirect, 2, 3}}
+	for _, config := range configs {
+		s.Backend, s.PruneFeatures, s.QueryHop = config.backend, config.prune, config.hop
+		backend := config.backend
+		for _, source := range sources {
+			for _, span := range [][2]int{{0, -1}, {3, 1100}} {
+				expected, err := spotifaux.MatchBruteForce(source.Name, source.DatFileName, s, span[0], span[1])
+				assert.NoError(t, err)
+				result, err := spotifaux.MatchRange(source.Name, source.DatFileName, s, span[0], span[1])
+				assert.NoError(t, err)
+
+				assert.Equal(t, expected.Pairs, result.Pairs)
+				if config.prune > 0 {
+					assert.Greater(t, result.Pruned, 0)
+				}
+				for i := range expected.Shingles {
+					want, got := expected.Shingles[i].Winners(), result.Shingles[i].Winners()
+					assert.Equal(t, len(want), len(got), backend.String())
+					for j := range want {
+						assert.Equal(t, want[j].Winner, got[j].Winner, backend.String())
+						assert.InDelta(t, want[j].MinDist, got[j].MinDist, 1e-9, backend.String())
+					}
+				}
+			}
+		}
+	}
+}
+
+func Test_autoBackendFollowsBenchmarks(t *testing.T) {
+	s := &spotifaux.SoundSpotter{ShingleSize: 11}
+
+	// the query shingles of BenchmarkMatch and BenchmarkMatchLongQuery, with their 18 features
+	for _, x := range []int{10, 100} {
+		assert.Equal(t, spotifaux.BackendQuantized, spotifaux.MatchBackendFor(s, x, 18, true))
+		assert.Equal(t, spotifaux.BackendFFT, spotifaux.MatchBackendFor(s, x, 18, false))
+	}
+	assert.Equal(t, spotifaux.BackendDirect, spotifaux.MatchBackendFor(s, 1, 18, false))
+
+	s.Backend = spotifaux.BackendDirect
+	assert.Equal(t, spotifaux.BackendDirect, spotifaux.MatchBackendFor(s, 100, 18, true))
+}
+
+func benchmarkMatch(b *testing.B, backend spotifaux.MatchBackend, queryFrames int,
+	match func(string, string, *spotifaux.SoundSpotter, int, int) (*spotifaux.MatchResult, error)) {
+	r := rand.New(rand.NewSource(3))
+	source := testCorpus(b, r, 20000, 1)[0]
+	s := testSpotter(r, queryFrames)
+	s.Backend = backend
+	s.ChosenFeatures = []int{3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20}
+	s.ShingleSize = 11
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		_, err := match(source.Name, source.DatFileName, s, 0, -1)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkMatch(b *testing.B) {
+	benchmarkMatch(b, spotifaux.BackendDirect, 110, spotifaux.MatchRange)
+}
+
+func BenchmarkMatchQuantized(b *testing.B) {
+	benchmarkMatch(b, spotifaux.BackendQuantized, 110, spotifaux.MatchRange)
+}
+
+func BenchmarkMatchBruteForce(b *testing.B) {
+	benchmarkMatch(b, spotifaux.BackendDirect, 110, spotifaux.MatchBruteForce)
+}
+
+func BenchmarkMatchLongQuery(b *testing.B) {
+	benchmarkMatch(b, spotifaux.BackendDirect, 1100, spotifaux.MatchRange)
+}
+
+func BenchmarkMatchLongQueryFFT(b *testing.B) {
+	benchmarkMatch(b, spotifaux.BackendFFT, 1100, spotifaux.MatchRange)
+}
+
+func BenchmarkMatchLongQueryQuantized(b *testing.B) {
+	benchmarkMatch(b, spotifaux.BackendQuantized, 1100, spotifaux.MatchRange)
+}
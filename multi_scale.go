@@ -0,0 +1,86 @@
+package spotifaux
+
+import (
+	"context"
+	"sort"
+)
+
+// MultiScale matches the query at several shingle sizes and covers it with variable length units.
+// Short shingles follow fast changes but sound granular, long ones are smooth but miss detail, so
+// each region of the query gets the longest unit whose distance is within Tolerance of the best unit
+// of the shortest size there. Distances of different sizes are only comparable for distances that do
+// not grow with the shingle length, such as the normalized ones.
+type MultiScale struct {
+	ShingleSizes []int
+	Tolerance    float64
+}
+
+// sizes returns the shingle sizes in ascending order
+func (m *MultiScale) sizes() []int {
+	sizes := append([]int(nil), m.ShingleSizes...)
+	sort.Ints(sizes)
+	return sizes
+}
+
+// Match matches the query of s against sources at each shingle size, in ascending order of size, with
+// matcher.MatchContext, so progress is reported for each size in turn. The query shingles of every size
+// start at the same frames, s.QueryHop apart, or the shortest size apart if it is not set.
+func (m *MultiScale) Match(ctx context.Context, matcher *CorpusMatcher, sources []FeatureSource, s *SoundSpotter,
+	progress ProgressFunc) ([]*MatchResult, error) {
+
+	sizes := m.sizes()
+	hop := s.QueryHop
+	if hop <= 0 {
+		hop = sizes[0]
+	}
+
+	results := make([]*MatchResult, len(sizes))
+	for k, size := range sizes {
+		t := *s
+		t.ShingleSize, t.QueryHop = size, hop
+		var err error
+		results[k], err = matcher.MatchContext(ctx, sources, &t, progress)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return results, nil
+}
+
+// Winners covers the query from its start with units from results, as returned by Match. Each unit
+// is the best candidate of the longest size within Tolerance of the best of the shortest size at its
+// query position, and the next unit starts at the last query shingle start it reaches. A shingle
+// without a candidate of the shortest size gets a silent unit of that size.
+func (m *MultiScale) Winners(results []*MatchResult) []Winner {
+	sizes := m.sizes()
+	base := results[0]
+	hop := base.QueryHop
+
+	var winners []Winner
+	for i := 0; i < len(base.Shingles); {
+		w := base.Shingles[i].Best()
+		w.Span = sizes[0]
+		if w.Winner >= 0 {
+			for k := len(sizes) - 1; k > 0; k-- {
+				if i >= len(results[k].Shingles) {
+					continue
+				}
+				long := results[k].Shingles[i].Best()
+				if long.Winner >= 0 && dist(long) <= dist(w)+m.Tolerance {
+					w = long
+					w.Span = sizes[k]
+					break
+				}
+			}
+		}
+		w.Query = i * hop
+		winners = append(winners, w)
+
+		step := w.Span / hop
+		if step < 1 {
+			step = 1
+		}
+		i += step
+	}
+	return winners
+}
@@ -0,0 +1,41 @@
+package spotifaux_test
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"math/rand"
+	"spotifaux"
+	"testing"
+)
+
+func Test_multiScaleTakesLongestCloseUnit(t *testing.T) {
+	r := rand.New(rand.NewSource(14))
+	s := testSpotter(r, 24)
+	s.TopK = 1
+
+	// the first 16 query frames are at frame 200 of the database, the rest nowhere
+	frames := randomFrames(r, 400)
+	copy(frames[200:], quantizeFrames(s.InShingles[:16]))
+	source := testCorpus(t, r, 400)[0]
+	writeTestDat(t, source.DatFileName, frames)
+
+	m := &spotifaux.MultiScale{ShingleSizes: []int{16, 4, 8}, Tolerance: 0.01}
+	results, err := m.Match(context.Background(), &spotifaux.CorpusMatcher{Workers: 2}, []spotifaux.FeatureSource{source},
+		s, nil)
+	assert.NoError(t, err)
+	assert.Len(t, results, 3)
+
+	winners := m.Winners(results)
+	assert.InDelta(t, 0, winners[0].MinDist, 1e-9)
+	winners[0].MinDist = 0
+	assert.Equal(t, spotifaux.Winner{Query: 0, File: source.Name, Span: 16, Winner: 200}, winners[0])
+	end := 0
+	for _, w := range winners {
+		assert.Equal(t, end, w.Query)
+		end = w.Query + w.Span
+	}
+	assert.Equal(t, len(s.InShingles), end)
+	for _, w := range winners[1:] {
+		assert.Less(t, w.Span, 16)
+	}
+}
@@ -0,0 +1,110 @@
+package spotifaux
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// NumPy .npy format version 1.0, see numpy.lib.format
+var npyMagic = []byte("\x93NUMPY\x01\x00")
+
+func writeNpyHeader(w io.Writer, descr string, shape []int) error {
+	dims := make([]string, len(shape))
+	for i, n := range shape {
+		dims[i] = strconv.Itoa(n)
+	}
+	shapeStr := strings.Join(dims, ", ")
+	if len(shape) == 1 {
+		shapeStr += ","
+	}
+
+	header := fmt.Sprintf("{'descr': %s, 'fortran_order': False, 'shape': (%s), }", descr, shapeStr)
+	// magic, header length and header are padded with spaces to a multiple of 64 bytes, ending in a newline
+	pad := 64 - (len(npyMagic)+2+len(header)+1)%64
+	if pad == 64 {
+		pad = 0
+	}
+	header += strings.Repeat(" ", pad) + "\n"
+
+	_, err := w.Write(npyMagic)
+	if err != nil {
+		return err
+	}
+	err = binary.Write(w, binary.LittleEndian, uint16(len(header)))
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, header)
+	return err
+}
+
+var npyDescr = regexp.MustCompile(`'descr':\s*'([^']*)'`)
+var npyFortran = regexp.MustCompile(`'fortran_order':\s*(True|False)`)
+var npyShape = regexp.MustCompile(`'shape':\s*\(([^)]*)\)`)
+
+// readNpyHeader reads the header of a plain (not structured) array and returns its dtype and shape
+func readNpyHeader(r io.Reader) (string, []int, error) {
+	magic := make([]byte, 8)
+	_, err := io.ReadFull(r, magic)
+	if err != nil {
+		return "", nil, err
+	}
+	if !bytes.Equal(magic[:6], npyMagic[:6]) {
+		return "", nil, errors.New("npy: bad magic")
+	}
+
+	var headerLen int
+	switch magic[6] {
+	case 1:
+		var n uint16
+		err = binary.Read(r, binary.LittleEndian, &n)
+		headerLen = int(n)
+	case 2, 3:
+		var n uint32
+		err = binary.Read(r, binary.LittleEndian, &n)
+		headerLen = int(n)
+	default:
+		return "", nil, fmt.Errorf("npy: unsupported version %d", magic[6])
+	}
+	if err != nil {
+		return "", nil, err
+	}
+
+	b := make([]byte, headerLen)
+	_, err = io.ReadFull(r, b)
+	if err != nil {
+		return "", nil, err
+	}
+	header := string(b)
+
+	descr := npyDescr.FindStringSubmatch(header)
+	fortran := npyFortran.FindStringSubmatch(header)
+	shapeStr := npyShape.FindStringSubmatch(header)
+	if descr == nil || fortran == nil || shapeStr == nil {
+		return "", nil, fmt.Errorf("npy: unsupported header %q", header)
+	}
+	if fortran[1] == "True" {
+		return "", nil, errors.New("npy: fortran order is not supported")
+	}
+
+	var shape []int
+	for _, dim := range strings.Split(shapeStr[1], ",") {
+		dim = strings.TrimSpace(dim)
+		if dim == "" {
+			continue
+		}
+		n, err := strconv.Atoi(dim)
+		if err != nil {
+			return "", nil, fmt.Errorf("npy: bad shape %q", shapeStr[1])
+		}
+		shape = append(shape, n)
+	}
+
+	return descr[1], shape, nil
+}
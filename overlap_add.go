@@ -0,0 +1,71 @@
+package spotifaux
+
+// OverlapAdd mixes rendered units into one stream. Overlapping units are crossfaded with a Hann window
+// and the mix is divided by the total window weight at each sample, so any amount of overlap keeps the
+// level of the units. Units that do not overlap are copied as they are, and gaps are silent.
+type OverlapAdd struct {
+	window []float64 // nil for no window
+	start  int       // sample of out[0]
+	out    []float64
+	weight []float64
+}
+
+// NewOverlapAdd mixes units of unitLength samples, windowing them if they will overlap. Units of other
+// lengths are windowed to their own length.
+func NewOverlapAdd(unitLength int, overlapping bool) *OverlapAdd {
+	o := &OverlapAdd{}
+	if overlapping {
+		o.window = hann(unitLength)
+	}
+	return o
+}
+
+// Add mixes unit in at sample at, which is no earlier than that of any unit added before, and returns
+// the samples before at, which no later unit can change
+func (o *OverlapAdd) Add(at int, unit []float64) []float64 {
+	done := o.take(at - o.start)
+
+	for len(o.out) < at-o.start+len(unit) {
+		o.out = append(o.out, 0)
+		o.weight = append(o.weight, 0)
+	}
+	window := o.window
+	if window != nil && len(window) != len(unit) {
+		window = hann(len(unit))
+	}
+	for t, v := range unit {
+		w := 1.0
+		if window != nil {
+			w = window[t]
+		}
+		o.out[at-o.start+t] += w * v
+		o.weight[at-o.start+t] += w
+	}
+	return done
+}
+
+// Flush returns the rest of the mix
+func (o *OverlapAdd) Flush() []float64 {
+	return o.take(len(o.out))
+}
+
+// take removes the first n samples of the mix and returns them normalized, silence past the mix
+func (o *OverlapAdd) take(n int) []float64 {
+	if n <= 0 {
+		return nil
+	}
+	done := make([]float64, n)
+	for i := 0; i < n && i < len(o.out); i++ {
+		if o.weight[i] > 0 {
+			done[i] = o.out[i] / o.weight[i]
+		}
+	}
+	if n < len(o.out) {
+		o.out = append(o.out[:0], o.out[n:]...)
+		o.weight = append(o.weight[:0], o.weight[n:]...)
+	} else {
+		o.out, o.weight = o.out[:0], o.weight[:0]
+	}
+	o.start += n
+	return done
+}
@@ -0,0 +1,50 @@
+package spotifaux_test
+
+import (
+	"github.com/stretchr/testify/assert"
+	"math/rand"
+	"spotifaux"
+	"testing"
+)
+
+func Test_overlappingShinglesRecordQueryPositions(t *testing.T) {
+	r := rand.New(rand.NewSource(7))
+	source := testCorpus(t, r, 300)[0]
+	s := testSpotter(r, 11)
+	s.QueryHop = 2
+
+	result, err := spotifaux.Match(source.Name, source.DatFileName, s)
+	assert.NoError(t, err)
+	winners := result.Winners()
+	assert.Len(t, winners, 5) // starting at 0, 2, 4, 6 and 8, the last running off the end
+	for i, w := range winners {
+		assert.Equal(t, 2*i, w.Query)
+	}
+}
+
+func Test_overlapAddKeepsLevel(t *testing.T) {
+	unit := make([]float64, 100)
+	for i := range unit {
+		unit[i] = 0.5
+	}
+
+	for _, hop := range []int{100, 50, 20} {
+		ola := spotifaux.NewOverlapAdd(len(unit), hop < len(unit))
+		var out []float64
+		for at := 0; at < 500; at += hop {
+			out = append(out, ola.Add(at, unit)...)
+		}
+		out = append(out, ola.Flush()...)
+
+		assert.Len(t, out, 500-hop+len(unit))
+		for _, v := range out {
+			assert.InDelta(t, 0.5, v, 1e-12)
+		}
+	}
+
+	// gaps between units are silent
+	ola := spotifaux.NewOverlapAdd(len(unit), false)
+	out := append(ola.Add(50, unit), ola.Flush()...)
+	assert.Equal(t, make([]float64, 50), out[:50])
+	assert.Equal(t, unit, out[50:])
+}
@@ -0,0 +1,89 @@
+package spotifaux
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os"
+)
+
+// The features are normalized frame by frame, so they say nothing about loudness. Extraction also
+// writes the power of each frame to a sidecar of the dat, a uint64 frame count followed by a float32
+// power in dB per frame.
+
+// silenceDB is the power of a silent frame
+const silenceDB = -100
+
+// PowerFileName is where the frame powers of the features in datFileName are stored
+func PowerFileName(datFileName string) string {
+	return datFileName + ".pow"
+}
+
+// framePower is the mean square of the samples of frame i's analysis window in dB
+func framePower(dbBuf []float64, i int) float64 {
+	power := 0.0
+	for j := 0; j < WindowLength && i*Hop+j < len(dbBuf); j++ {
+		power += dbBuf[i*Hop+j] * dbBuf[i*Hop+j]
+	}
+	return math.Max(silenceDB, 10*math.Log10(power/WindowLength))
+}
+
+func writePowers(fileName string, powers []float64) error {
+	f, err := os.Create(fileName)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+	err = binary.Write(w, binary.LittleEndian, uint64(len(powers)))
+	if err != nil {
+		return err
+	}
+	for _, power := range powers {
+		err = binary.Write(w, binary.LittleEndian, float32(power))
+		if err != nil {
+			return err
+		}
+	}
+	return w.Flush()
+}
+
+// ReadPowers returns the frame powers in dB of the features in datFileName
+func ReadPowers(datFileName string) ([]float64, error) {
+	f, err := os.Open(PowerFileName(datFileName))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	var frames uint64
+	err = binary.Read(r, binary.LittleEndian, &frames)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if int64(frames) != (fi.Size()-8)/4 {
+		return nil, fmt.Errorf("%s: %d frames in a file of %d bytes", f.Name(), frames, fi.Size())
+	}
+
+	b := make([]float32, frames)
+	err = binary.Read(r, binary.LittleEndian, b)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return nil, err
+	}
+	powers := make([]float64, frames)
+	for i, power := range b {
+		powers[i] = float64(power)
+	}
+	return powers, nil
+}
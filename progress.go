@@ -0,0 +1,115 @@
+package spotifaux
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+// Progress is how far a match or a feature extraction has got
+type Progress struct {
+	Frames      int // database positions matched, or audio frames extracted
+	TotalFrames int // of the files started so far when extracting
+	Files       int // files finished
+	TotalFiles  int
+	Best        []float64 // distance of the best candidate of each query shingle so far, nil when extracting
+	Elapsed     time.Duration
+	Remaining   time.Duration // estimated from the rate so far, 0 until there is one
+}
+
+// ProgressFunc receives the progress of long running work. Calls are never concurrent, but come from
+// the goroutines doing the work, so should return quickly.
+type ProgressFunc func(Progress)
+
+// progressBlock is the number of frames between reports and cancellation checks of work that is not
+// done in blocks anyway
+const progressBlock = matchBlock
+
+// tracker stops work when its context is cancelled and reports its progress. A nil tracker does neither.
+type tracker struct {
+	ctx     context.Context
+	report  ProgressFunc
+	start   time.Time
+	byFiles bool // estimate the time remaining from the files done, as the frames are only known file by file
+	mu      sync.Mutex
+	p       Progress
+}
+
+// newTracker tracks work over totalFrames frames of totalFiles files, for a query of shingles shingles.
+// The frames may instead be added as each file's become known.
+func newTracker(ctx context.Context, report ProgressFunc, totalFrames, totalFiles, shingles int) *tracker {
+	t := &tracker{ctx: ctx, report: report, start: time.Now(), byFiles: totalFrames == 0 && totalFiles > 1}
+	t.p.TotalFrames, t.p.TotalFiles = totalFrames, totalFiles
+	if shingles > 0 {
+		t.p.Best = make([]float64, shingles)
+		for i := range t.p.Best {
+			t.p.Best[i] = math.Inf(1)
+		}
+	}
+	return t
+}
+
+// advance records n more frames done, and the best candidates so far of result if it is not nil. It
+// returns the error of the context once it is cancelled.
+func (t *tracker) advance(n int, result *MatchResult) error {
+	if t == nil {
+		return nil
+	}
+	if err := t.ctx.Err(); err != nil {
+		return err
+	}
+	if t.report == nil {
+		return nil
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.p.Frames += n
+	if result != nil {
+		for i, c := range result.Shingles {
+			if d := dist(c.Best()); i < len(t.p.Best) && d < t.p.Best[i] {
+				t.p.Best[i] = d
+			}
+		}
+	}
+	t.send()
+	return nil
+}
+
+// addTotalFrames records that another n frames are to be done
+func (t *tracker) addTotalFrames(n int) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.p.TotalFrames += n
+}
+
+// fileDone records that another file is finished
+func (t *tracker) fileDone() {
+	if t == nil || t.report == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.p.Files++
+	t.send()
+}
+
+// send reports a copy of the progress
+func (t *tracker) send() {
+	t.p.Elapsed = time.Since(t.start)
+	done, total := t.p.Frames, t.p.TotalFrames
+	if t.byFiles {
+		done, total = t.p.Files, t.p.TotalFiles
+	}
+	if done > 0 && total >= done {
+		t.p.Remaining = time.Duration(float64(t.p.Elapsed) * float64(total-done) / float64(done))
+	}
+
+	p := t.p
+	p.Best = append([]float64(nil), t.p.Best...)
+	t.report(p)
+}
@@ -0,0 +1,81 @@
+package spotifaux_test
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"math/rand"
+	"spotifaux"
+	"testing"
+)
+
+func Test_matchContextReportsProgress(t *testing.T) {
+	r := rand.New(rand.NewSource(15))
+	sources := testCorpus(t, r, 2500, 3, 2500)
+	s := testSpotter(r, 24)
+
+	var reports []spotifaux.Progress
+	m := &spotifaux.CorpusMatcher{Workers: 2, ChunkFrames: 1000}
+	result, err := m.MatchContext(context.Background(), sources, s, func(p spotifaux.Progress) {
+		reports = append(reports, p)
+	})
+	assert.NoError(t, err)
+
+	expected, err := m.Match(sources, s)
+	assert.NoError(t, err)
+	assert.Equal(t, expected.Winners(), result.Winners())
+
+	last := reports[len(reports)-1]
+	assert.Equal(t, 2500+3+2500, last.TotalFrames)
+	assert.Equal(t, last.TotalFrames, last.Frames)
+	assert.Equal(t, 3, last.Files)
+	assert.Equal(t, 3, last.TotalFiles)
+	for i, w := range result.Winners() {
+		assert.Equal(t, w.MinDist, last.Best[i])
+	}
+	for i := 1; i < len(reports); i++ {
+		assert.GreaterOrEqual(t, reports[i].Frames, reports[i-1].Frames)
+	}
+}
+
+func Test_matchContextStopsWhenCancelled(t *testing.T) {
+	r := rand.New(rand.NewSource(16))
+	sources := testCorpus(t, r, 5000, 5000)
+	s := testSpotter(r, 24)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	frames := 0
+	_, err := spotifaux.MatchContext(ctx, sources[0].Name, sources[0].DatFileName, s, func(p spotifaux.Progress) {
+		frames = p.Frames
+		cancel()
+	})
+	assert.Equal(t, context.Canceled, err)
+	assert.Less(t, frames, 5000)
+
+	_, err = (&spotifaux.CorpusMatcher{Workers: 2}).MatchContext(ctx, sources, s, nil)
+	assert.Equal(t, context.Canceled, err)
+}
+
+func Test_shingleIndexStopsWhenCancelled(t *testing.T) {
+	r := rand.New(rand.NewSource(48))
+	sources := testCorpus(t, r, 3000, 3000)
+	s := testSpotter(r, 24)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	frames := 0
+	_, err := spotifaux.BuildShingleIndexContext(ctx, sources, s, 4, 8, 1, func(p spotifaux.Progress) {
+		frames = p.Frames
+		cancel()
+	})
+	assert.Equal(t, context.Canceled, err)
+	assert.Less(t, frames, 6000)
+
+	ix, err := spotifaux.BuildShingleIndex(sources, s, 4, 8, 1)
+	assert.NoError(t, err)
+	result, err := ix.MatchContext(context.Background(), s, nil)
+	assert.NoError(t, err)
+	expected, err := ix.Match(s)
+	assert.NoError(t, err)
+	assert.Equal(t, expected.Winners(), result.Winners())
+	_, err = ix.MatchContext(ctx, s, nil)
+	assert.Equal(t, context.Canceled, err)
+}
@@ -0,0 +1,146 @@
+package spotifaux
+
+import (
+	"math"
+	"sort"
+)
+
+// pruneSlack keeps rounding differences between the bound and the exact distance from pruning a
+// position the full scan would have kept
+const pruneSlack = 1e-9
+
+// pruner skips positions that cannot beat a shingle's K-th best candidate, using a bound on the
+// distance from a few head features. It works for any normDistance, which only decreases as the
+// cross term grows.
+//
+// Split the chosen features into the s.PruneFeatures with the most query energy and the rest. The
+// head cross term is computed like the direct backend, but by Cauchy-Schwarz each frame's tail cross
+// term is at most the product of the frames' tail norms, which gives an upper bound on the cross term and
+// so a lower bound on the distance. Positions whose bound cannot beat the K-th best are skipped, and
+// the rest have the bound tightened frame by frame as the exact tail terms replace the norm products,
+// abandoning a position as soon as it cannot win.
+type pruner struct {
+	shingleSize int
+	head, tail  []int // positions of the head and tail features in a chosen-feature vector
+
+	qHead, qTail [][]float64 // query frames split into head and tail features
+	qTailN       []float64   // tail norm of each query frame
+
+	dbHead, dbTail [][]float64 // window frames split into head and tail features
+	dbTailN        []float64
+	D              [][]float64 // head per-frame dot products, query frame x database frame
+}
+
+func newPruner(q [][]float64, s *SoundSpotter) *pruner {
+	features := len(s.ChosenFeatures)
+	energy := make([]float64, features)
+	for _, frame := range q {
+		for f, v := range frame {
+			energy[f] += v * v
+		}
+	}
+	order := make([]int, features)
+	for f := range order {
+		order[f] = f
+	}
+	sort.SliceStable(order, func(i, j int) bool { return energy[order[i]] > energy[order[j]] })
+
+	headN := s.PruneFeatures
+	if headN > features {
+		headN = features
+	}
+	p := &pruner{
+		shingleSize: s.ShingleSize,
+		head:        order[:headN],
+		tail:        order[headN:],
+	}
+	sort.Ints(p.head)
+	sort.Ints(p.tail)
+
+	p.qHead = make([][]float64, len(q))
+	p.qTail = make([][]float64, len(q))
+	for i, frame := range q {
+		p.qHead[i] = chosenFeatures(frame, p.head)
+		p.qTail[i] = chosenFeatures(frame, p.tail)
+	}
+	p.qTailN = make([]float64, len(q))
+	for qi := range q {
+		p.qTailN[qi] = math.Sqrt(dot(p.qTail[qi], p.qTail[qi]))
+	}
+
+	window := matchBlock + s.ShingleSize - 1
+	p.dbHead = make([][]float64, window)
+	p.dbTail = make([][]float64, window)
+	for j := 0; j < window; j++ {
+		p.dbHead[j] = make([]float64, len(p.head))
+		p.dbTail[j] = make([]float64, len(p.tail))
+	}
+	p.dbTailN = make([]float64, window)
+	p.D = make([][]float64, len(q))
+	for i := range p.D {
+		p.D[i] = make([]float64, window)
+	}
+	return p
+}
+
+// match offers the positions of one block to the candidates as matchRange does, given the database
+// window db from position b0 and its shingle norms sk, and returns the number of pairs pruned
+func (p *pruner) match(fileName string, db [][]float64, b0, positions int, qN, sk []float64, sc *scorer,
+	result *MatchResult) int {
+
+	w := len(db)
+	for j := 0; j < w; j++ {
+		for i, f := range p.head {
+			p.dbHead[j][i] = db[j][f]
+		}
+		for i, f := range p.tail {
+			p.dbTail[j][i] = db[j][f]
+		}
+		p.dbTailN[j] = math.Sqrt(dot(p.dbTail[j], p.dbTail[j]))
+	}
+
+	for qi := range p.qHead {
+		for j := 0; j < w; j++ {
+			p.D[qi][j] = dot(p.qHead[qi], p.dbHead[j])
+		}
+	}
+
+	pruned := 0
+	for ins, candidates := range result.Shingles {
+		for pos := 0; pos < positions; pos++ {
+			DD, tail := 0.0, 0.0
+			for muxi := 0; muxi < p.shingleSize && pos+muxi < w; muxi++ {
+				qi := ins*p.shingleSize + muxi
+				DD += p.D[qi][pos+muxi]
+				tail += p.qTailN[qi] * p.dbTailN[pos+muxi]
+			}
+
+			abandoned := false
+			for muxi := 0; muxi < p.shingleSize && pos+muxi < w; muxi++ {
+				if sc.score(ins, b0+pos, DD+tail, qN[ins], sk[pos])-pruneSlack > candidates.Worst() {
+					abandoned = true
+					break
+				}
+				qi := ins*p.shingleSize + muxi
+				DD += dot(p.qTail[qi], p.dbTail[pos+muxi])
+				tail -= p.qTailN[qi] * p.dbTailN[pos+muxi]
+			}
+			if abandoned {
+				pruned++
+				continue
+			}
+
+			dRadius := sc.score(ins, b0+pos, DD, qN[ins], sk[pos])
+
+			// Perform min-dist search
+			if dRadius < candidates.Worst() || candidates.Len() == 0 {
+				candidates.Push(Winner{
+					File:    fileName,
+					MinDist: dRadius,
+					Winner:  b0 + pos,
+				})
+			}
+		}
+	}
+	return pruned
+}
@@ -0,0 +1,156 @@
+package spotifaux
+
+import (
+	"fmt"
+	"math"
+	"spotifaux/internal/kernel"
+)
+
+// quantize maps a dequantized feature back to its stored byte, centred on zero
+func quantize(feature float64) (int16, bool) {
+	v := feature * 255
+	r := math.Round(v)
+	return int16(math.Max(-128, math.Min(127, r))), math.Abs(v-r) < 1e-6 && r >= -128 && r <= 127
+}
+
+// queryQuantized reports whether every chosen query feature is a dequantized byte, as it is when
+// the query was read from a dat, so that the quantized backend gives the same distances
+func queryQuantized(s *SoundSpotter) bool {
+	for _, frame := range s.InShingles {
+		for _, qp := range s.ChosenFeatures {
+			if _, ok := quantize(frame[qp]); !ok {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// matchQuantized is matchRange on the stored bytes. Query and database frames are centred int16
+// vectors padded to kernel.Lanes, so the per-frame dot products run in the integer SIMD kernel, and
+// the cross terms and norms are exact integer sums until they are scaled for the distance. The window buffers are
+// allocated once, so nothing is allocated per frame. The distances are only those of matchRange for a
+// query read from a dat and a distance that does not transform frames, so any other is refused.
+func matchQuantized(t *tracker, fileName string, dr *datReader, s *SoundSpotter, sc *scorer,
+	from, to int) (*MatchResult, error) {
+
+	if !dr.Quantized() {
+		return nil, fmt.Errorf("%s: quantized backend needs byte features", fileName)
+	}
+	if sc.transform != nil {
+		return nil, fmt.Errorf("%s: quantized backend cannot match under %s, which transforms frames", fileName,
+			s.distance().Name())
+	}
+	if !queryQuantized(s) {
+		return nil, fmt.Errorf("%s: quantized backend needs a query of byte features, as read from a dat", fileName)
+	}
+
+	x := queryShingles(s)
+	result := NewMatchResult(x, s)
+
+	features := len(s.ChosenFeatures)
+	stride := kernel.Stride(features)
+	q := make([]int16, x*s.ShingleSize*stride)
+	qN := make([]float64, x)
+	for ins := 0; ins < x; ins++ {
+		n := int64(0)
+		for muxi := 0; muxi < s.ShingleSize; muxi++ {
+			qi := ins*s.ShingleSize + muxi
+			row := q[qi*stride : qi*stride+features]
+			for i, qp := range s.ChosenFeatures {
+				row[i], _ = quantize(queryFrame(s, ins, muxi)[qp])
+			}
+			n += int64(kernel.Dot(row, row))
+		}
+		qN[ins] = math.Sqrt(float64(n)) / 255
+	}
+
+	window := matchBlock + s.ShingleSize - 1
+	raw := make([]byte, window*s.CqtN)
+	db := make([]int16, window*stride) // database frames from b0
+	nk := make([]int64, window)        // database frame norms
+	sk := make([]float64, window)
+	D := make([][]int32, s.ShingleSize) // per-frame dot products of one query shingle, kept in cache
+	for i := range D {
+		D[i] = make([]int32, window)
+	}
+
+	w := 0
+	for b0 := from; b0 < to; b0 += matchBlock {
+		b1 := b0 + matchBlock
+		if b1 > to {
+			b1 = to
+		}
+		end := b1 + s.ShingleSize - 1
+		if end > dr.Frames {
+			end = dr.Frames
+		}
+
+		// keep the frames shared with the previous block's window and read the rest
+		if w > 0 {
+			copy(db, db[matchBlock*stride:w*stride])
+			copy(nk, nk[matchBlock:w])
+			w -= matchBlock
+		}
+		n := end - b0 - w
+		err := dr.ReadRaw(raw[:n*s.CqtN])
+		if err != nil {
+			return nil, err
+		}
+		for j := 0; j < n; j++ {
+			row := db[(w+j)*stride : (w+j)*stride+features]
+			frame := raw[j*s.CqtN : (j+1)*s.CqtN]
+			for i, qp := range s.ChosenFeatures {
+				row[i] = int16(frame[qp]) - 128
+			}
+			nk[w+j] = int64(kernel.Dot(row, row))
+		}
+		w += n
+
+		// sliding sums of frame norms, exact in integers
+		sum := int64(0)
+		for j := 0; j < s.ShingleSize && j < w; j++ {
+			sum += nk[j]
+		}
+		for p := 0; p < b1-b0; p++ {
+			sk[p] = math.Sqrt(float64(sum)) / 255
+			sum -= nk[p]
+			if p+s.ShingleSize < w {
+				sum += nk[p+s.ShingleSize]
+			}
+		}
+
+		result.Pairs += x * (b1 - b0)
+		for ins := 0; ins < x; ins++ {
+			for muxi := range D {
+				qi := ins*s.ShingleSize + muxi
+				kernel.DotRows(q[qi*stride:(qi+1)*stride], db[:w*stride], D[muxi][:w])
+			}
+
+			candidates := result.Shingles[ins]
+			for p := 0; p < b1-b0; p++ {
+				DD := int64(0)
+				for muxi := 0; muxi < s.ShingleSize && p+muxi < w; muxi++ {
+					DD += int64(D[muxi][p+muxi])
+				}
+
+				dRadius := sc.score(ins, b0+p, float64(DD)/(255*255), qN[ins], sk[p])
+
+				// Perform min-dist search
+				if dRadius < candidates.Worst() || candidates.Len() == 0 {
+					candidates.Push(Winner{
+						File:    fileName,
+						MinDist: dRadius,
+						Winner:  b0 + p,
+					})
+				}
+			}
+		}
+
+		err = t.advance(b1-b0, result)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
@@ -1,11 +1,37 @@
 package spotifaux
 
 type Winner struct {
-	File    string `json:"file"`
-	Winner  int    `json:"winner"`
-	MinDist float64
+	Query     int     `json:"query"` // first query frame of the shingle the winner was chosen for
+	File      string  `json:"file"`
+	Winner    int     `json:"winner"`
+	Span      int     `json:"span,omitempty"`      // query frames the unit covers, 0 for ShingleSize
+	Length    int     `json:"length,omitempty"`    // database frames matched by a time warped shingle, 0 for its span
+	Transpose int     `json:"transpose,omitempty"` // semitones the unit is shifted up by to match
+	Reversed  bool    `json:"reversed,omitempty"`  // the unit is played backwards
+	Gain      float64 `json:"gain,omitempty"`      // dB the unit is made louder by
+	Fallback  string  `json:"fallback,omitempty"`  // the Fallback of a shingle with no candidate within MaxDistance
+	MinDist   float64
+}
+
+// span is the number of query frames w covers
+func (w Winner) span(shingleSize int) int {
+	if w.Span > 0 {
+		return w.Span
+	}
+	return shingleSize
+}
+
+// length is the number of database frames w plays
+func (w Winner) length(shingleSize int) int {
+	if w.Length > 0 {
+		return w.Length
+	}
+	return w.span(shingleSize)
 }
 
 type Recipe struct {
-	Winner []Winner `json:"recipe"`
+	Distance string   `json:"distance,omitempty"` // Name of the distance the winners were chosen by
+	Hop      int      `json:"hop,omitempty"`      // frames between query shingles, 0 in recipes without query positions
+	Sampled  *Sampler `json:"sampled,omitempty"`  // how the winners were drawn, nil if each is the best
+	Winner   []Winner `json:"recipe"`
 }
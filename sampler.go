@@ -0,0 +1,49 @@
+package spotifaux
+
+import (
+	"math"
+	"math/rand"
+)
+
+// Sampler draws the winner of each query shingle from its candidates instead of taking the best, so
+// that one match gives many variations of a mosaic. A candidate is drawn with probability proportional
+// to exp(-(MinDist - best MinDist) / Temperature), so a Temperature of 0 always takes the best and
+// higher temperatures make worse candidates more likely. The same Seed draws the same winners.
+type Sampler struct {
+	Temperature float64 `json:"temperature"`
+	Seed        int64   `json:"seed"`
+}
+
+// Winners draws a candidate of each shingle of result, with the query position of its shingle
+func (sm *Sampler) Winners(result *MatchResult) []Winner {
+	r := rand.New(rand.NewSource(sm.Seed))
+	winners := make([]Winner, len(result.Shingles))
+	for i, c := range result.Shingles {
+		winners[i] = sm.sample(r, selectable(c))
+		winners[i].Query = i * result.QueryHop
+	}
+	return winners
+}
+
+// sample draws one of candidates, which are best first
+func (sm *Sampler) sample(r *rand.Rand, candidates []Winner) Winner {
+	u := r.Float64() // drawn for every shingle, so a shingle's draw does not depend on the others' candidates
+	if sm.Temperature <= 0 || len(candidates) == 1 {
+		return candidates[0]
+	}
+
+	weights := make([]float64, len(candidates))
+	total := 0.0
+	for k, w := range candidates {
+		weights[k] = math.Exp(-(w.MinDist - candidates[0].MinDist) / sm.Temperature)
+		total += weights[k]
+	}
+	u *= total
+	for k, weight := range weights {
+		if u < weight {
+			return candidates[k]
+		}
+		u -= weight
+	}
+	return candidates[len(candidates)-1]
+}
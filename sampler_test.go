@@ -0,0 +1,40 @@
+package spotifaux_test
+
+import (
+	"github.com/stretchr/testify/assert"
+	"math"
+	"math/rand"
+	"spotifaux"
+	"testing"
+)
+
+func Test_samplerDrawsBySoftmax(t *testing.T) {
+	r := rand.New(rand.NewSource(10))
+	s := testSpotter(r, 4)
+	s.TopK = 2
+
+	result := spotifaux.NewMatchResult(2000, s)
+	for _, c := range result.Shingles {
+		c.Push(spotifaux.Winner{File: "a", Winner: 1, MinDist: 0.1})
+		c.Push(spotifaux.Winner{File: "a", Winner: 2, MinDist: 0.2})
+	}
+
+	cold := spotifaux.Sampler{Temperature: 0, Seed: 1}
+	assert.Equal(t, result.Winners(), cold.Winners(result))
+
+	warm := spotifaux.Sampler{Temperature: 0.1, Seed: 1}
+	winners := warm.Winners(result)
+	assert.Equal(t, winners, warm.Winners(result))
+	other := spotifaux.Sampler{Temperature: 0.1, Seed: 2}
+	assert.NotEqual(t, winners, other.Winners(result))
+
+	seconds := 0
+	for i, w := range winners {
+		assert.Equal(t, 4*i, w.Query)
+		if w.Winner == 2 {
+			seconds++
+		}
+	}
+	want := math.Exp(-1) / (1 + math.Exp(-1))
+	assert.InDelta(t, want, float64(seconds)/float64(len(winners)), 0.03)
+}
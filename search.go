@@ -0,0 +1,124 @@
+package spotifaux
+
+import (
+	"context"
+	"math"
+	"sort"
+)
+
+// searchCandidates is how many candidates per hit Search first keeps for non-maximum suppression to
+// choose from
+const searchCandidates = 4
+
+// Hit is a place in the corpus that sounds like a search query
+type Hit struct {
+	File         string  `json:"file"`
+	Start        float64 `json:"start"` // seconds
+	End          float64 `json:"end"`   // seconds
+	Distance     float64 `json:"distance"`
+	Frame        int     `json:"frame"`         // first feature frame of the hit
+	Frames       int     `json:"frames"`        // feature frames of the hit
+	FileDuration float64 `json:"file_duration"` // seconds of the whole file
+	Transpose    int     `json:"transpose,omitempty"`
+	Reversed     bool    `json:"reversed,omitempty"`
+}
+
+// Searcher uses the corpus as a search engine, finding the places most like a short clip
+type Searcher struct {
+	Hits    int     // hits returned at most
+	Overlap float64 // fraction of the shorter of two hits of a file they may share, 0 for none
+}
+
+// Search matches the whole query of s against sources as a single shingle and returns the best hits,
+// best first. Non-maximum suppression drops any hit overlapping a better one by more than Overlap, and
+// while that leaves fewer than Hits, the corpus is matched again keeping twice the candidates, until
+// it has no more.
+func (q *Searcher) Search(ctx context.Context, matcher *CorpusMatcher, sources []FeatureSource, s *SoundSpotter,
+	progress ProgressFunc) ([]Hit, error) {
+
+	if len(s.InShingles) == 0 || q.Hits <= 0 {
+		return nil, nil
+	}
+	t := *s
+	t.ShingleSize, t.QueryHop = len(s.InShingles), len(s.InShingles)
+	// candidates of the query's length starting closer than this would be suppressed anyway
+	t.MinSeparation = int(math.Ceil((1 - q.Overlap) * float64(t.ShingleSize)))
+	var kept []Winner
+	for t.TopK = searchCandidates * q.Hits; ; t.TopK *= 2 {
+		result, err := matcher.MatchContext(ctx, sources, &t, progress)
+		if err != nil {
+			return nil, err
+		}
+		candidates := result.Shingles[0].Winners()
+		kept = q.suppress(candidates, t.ShingleSize)
+		if len(kept) == q.Hits || len(candidates) < t.TopK {
+			break
+		}
+	}
+
+	frames, err := sourceFrames(sources, s.CqtN)
+	if err != nil {
+		return nil, err
+	}
+	fileFrames := map[string]int{}
+	for i, source := range sources {
+		fileFrames[source.Name] = frames[i]
+	}
+
+	var hits []Hit
+	for _, w := range kept {
+		length := w.length(t.ShingleSize)
+		if end := fileFrames[w.File]; w.Winner+length > end {
+			length = end - w.Winner // a shingle running off the end matched the frames there are
+		}
+		hits = append(hits, Hit{
+			File:         w.File,
+			Start:        FrameTime(w.Winner),
+			End:          FrameTime(w.Winner + length),
+			Distance:     w.MinDist,
+			Frame:        w.Winner,
+			Frames:       length,
+			FileDuration: FrameTime(fileFrames[w.File]),
+			Transpose:    w.Transpose,
+			Reversed:     w.Reversed,
+		})
+	}
+	return hits, nil
+}
+
+// suppress keeps up to q.Hits of candidates, taking them best first and skipping any that overlap one
+// already kept by more than q.Overlap. Candidates without a distance are never hits.
+func (q *Searcher) suppress(candidates []Winner, shingleSize int) []Winner {
+	sort.Slice(candidates, func(i, j int) bool {
+		return better(candidates[i], candidates[j])
+	})
+
+	var kept []Winner
+	for _, w := range candidates {
+		if len(kept) == q.Hits {
+			break
+		}
+		if w.Winner < 0 || math.IsNaN(w.MinDist) || math.IsInf(w.MinDist, 0) {
+			continue
+		}
+		suppressed := false
+		for _, k := range kept {
+			if k.File == w.File && q.overlaps(k, w, shingleSize) {
+				suppressed = true
+				break
+			}
+		}
+		if !suppressed {
+			kept = append(kept, w)
+		}
+	}
+	return kept
+}
+
+// overlaps is whether a and b share more than q.Overlap of the shorter of them
+func (q *Searcher) overlaps(a, b Winner, shingleSize int) bool {
+	aEnd, bEnd := a.Winner+a.length(shingleSize), b.Winner+b.length(shingleSize)
+	shared := math.Min(float64(aEnd), float64(bEnd)) - math.Max(float64(a.Winner), float64(b.Winner))
+	shorter := math.Min(float64(a.length(shingleSize)), float64(b.length(shingleSize)))
+	return shared > q.Overlap*shorter
+}
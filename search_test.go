@@ -0,0 +1,83 @@
+package spotifaux_test
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"math/rand"
+	"spotifaux"
+	"testing"
+)
+
+func Test_searchFindsNonOverlappingHits(t *testing.T) {
+	r := rand.New(rand.NewSource(17))
+	s := testSpotter(r, 20)
+
+	// the clip at frames 100 and 300 of one file and, slightly changed, at frame 50 of another
+	clip := quantizeFrames(s.InShingles)
+	a, b := randomFrames(r, 500), randomFrames(r, 200)
+	for i := range clip {
+		copy(a[100+i], clip[i])
+		copy(a[300+i], clip[i])
+		copy(b[50+i], clip[i])
+		b[50+i][1] ^= 8
+	}
+	sources := testCorpus(t, r, 500, 200, 1)[:2]
+	writeTestDat(t, sources[0].DatFileName, a)
+	writeTestDat(t, sources[1].DatFileName, b)
+
+	searcher := &spotifaux.Searcher{Hits: 4}
+	hits, err := searcher.Search(context.Background(), &spotifaux.CorpusMatcher{Workers: 2}, sources, s, nil)
+	assert.NoError(t, err)
+	assert.Len(t, hits, 4)
+
+	assert.Equal(t, sources[0].Name, hits[0].File)
+	assert.Equal(t, sources[0].Name, hits[1].File)
+	assert.ElementsMatch(t, []int{100, 300}, []int{hits[0].Frame, hits[1].Frame})
+	assert.Equal(t, spotifaux.Hit{
+		File:         sources[1].Name,
+		Start:        spotifaux.FrameTime(50),
+		End:          spotifaux.FrameTime(70),
+		Distance:     hits[2].Distance,
+		Frame:        50,
+		Frames:       20,
+		FileDuration: spotifaux.FrameTime(200),
+	}, hits[2])
+	assert.Greater(t, hits[2].Distance, hits[1].Distance)
+	assert.Less(t, hits[2].Distance, hits[3].Distance)
+
+	for i, hit := range hits {
+		for _, other := range hits[:i] {
+			if hit.File == other.File {
+				assert.True(t, hit.Frame >= other.Frame+other.Frames || other.Frame >= hit.Frame+hit.Frames)
+			}
+		}
+	}
+}
+
+func Test_searchKeepsHitsOverlappingByNoMoreThanOverlap(t *testing.T) {
+	r := rand.New(rand.NewSource(18))
+	s := testSpotter(r, 20)
+
+	// a clip repeating every 5 frames, found whole 9 times in 60 frames of a file, 5 frames apart
+	period := randomFrames(r, 5)
+	a := randomFrames(r, 300)
+	for i := 0; i < 60; i++ {
+		copy(a[100+i], period[i%5])
+	}
+	for i := range s.InShingles {
+		for j, b := range period[i%5] {
+			s.InShingles[i][j] = (float64(b) - 128) / 255
+		}
+	}
+	sources := testCorpus(t, r, 300, 1)[:1]
+	writeTestDat(t, sources[0].DatFileName, a)
+
+	// hits 5 frames apart share 15 of their 20 frames
+	searcher := &spotifaux.Searcher{Hits: 6, Overlap: 0.75}
+	hits, err := searcher.Search(context.Background(), &spotifaux.CorpusMatcher{}, sources, s, nil)
+	assert.NoError(t, err)
+	assert.Len(t, hits, 6)
+	for _, hit := range hits {
+		assert.True(t, hit.Frame >= 100 && hit.Frame <= 140 && hit.Frame%5 == 0, "%d", hit.Frame)
+	}
+}
@@ -0,0 +1,442 @@
+package spotifaux
+
+import (
+	"context"
+	"encoding/gob"
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// ShingleIndex is a random-projection LSH index over the database shingles of a corpus, so a query
+// shingle only needs to be compared with positions in its buckets instead of every frame.
+//
+// Each of Tables hash tables keys a shingle by the signs of its projections on Bits random
+// directions. Shingles at a small angle, which is what the normalized matched filter distance
+// measures, agree on most signs and so tend to share buckets. More tables raise recall, more bits
+// make buckets smaller and queries faster. Distances that are not angular, such as squared
+// Euclidean, do not keep close shingles in the same buckets, so they cannot be matched through it.
+type ShingleIndex struct {
+	Sources        []FeatureSource
+	Offsets        []int // id of the first position of each source
+	ChosenFeatures []int
+	ShingleSize    int
+	CqtN           int
+	Tables         int
+	Bits           int
+	Seed           int64
+
+	Keys [][]uint64 // per table, the sorted bucket keys of the positions in IDs
+	IDs  [][]uint32
+
+	Probes int // buckets also searched per table with one of this many least certain bits flipped
+
+	directions [][]float64 // Tables*Bits random directions of ShingleSize*len(ChosenFeatures)
+}
+
+// BuildShingleIndex hashes every full shingle of the sources with the features and shingle size of s
+func BuildShingleIndex(sources []FeatureSource, s *SoundSpotter, tables, bits int, seed int64) (*ShingleIndex, error) {
+	return BuildShingleIndexContext(context.Background(), sources, s, tables, bits, seed, nil)
+}
+
+// BuildShingleIndexContext is BuildShingleIndex stopping with the error of ctx once it is cancelled, and
+// reporting its progress to progress if it is not nil
+func BuildShingleIndexContext(ctx context.Context, sources []FeatureSource, s *SoundSpotter, tables, bits int,
+	seed int64, progress ProgressFunc) (*ShingleIndex, error) {
+
+	if bits < 1 || bits > 64 {
+		return nil, fmt.Errorf("index bits %d not in 1..64", bits)
+	}
+	if tables < 1 {
+		return nil, fmt.Errorf("index tables %d less than 1", tables)
+	}
+	if !angular(s.distance()) {
+		return nil, fmt.Errorf("index hashes the angle between shingles, which %s distance does not rank by",
+			s.distance().Name())
+	}
+
+	ix := &ShingleIndex{
+		Sources:        sources,
+		ChosenFeatures: s.ChosenFeatures,
+		ShingleSize:    s.ShingleSize,
+		CqtN:           s.CqtN,
+		Tables:         tables,
+		Bits:           bits,
+		Seed:           seed,
+		Keys:           make([][]uint64, tables),
+		IDs:            make([][]uint32, tables),
+	}
+	ix.makeDirections()
+
+	frames, err := sourceFrames(sources, s.CqtN)
+	if err != nil {
+		return nil, err
+	}
+	total := 0
+	for _, n := range frames {
+		total += n
+	}
+	t := newTracker(ctx, progress, total, len(sources), 0)
+
+	id := 0
+	keys := make([]uint64, tables)
+	projections := make([]float64, tables*bits)
+	window := make([][]float64, s.ShingleSize)
+	for _, source := range sources {
+		ix.Offsets = append(ix.Offsets, id)
+
+		dr, err := NewDatReader(source.DatFileName, s.CqtN)
+		if err != nil {
+			return nil, err
+		}
+		if err = dr.checkChosen(s.ChosenFeatures); err != nil {
+			dr.Close()
+			return nil, err
+		}
+		for j := 0; j < dr.Frames; j++ {
+			features, err := dr.Dat()
+			if err != nil {
+				dr.Close()
+				return nil, err
+			}
+			window = append(window[:0], window[1:]...)
+			window = append(window, chosenFeatures(features, s.ChosenFeatures))
+			if (j+1)%progressBlock == 0 || j == dr.Frames-1 {
+				if err = t.advance(j%progressBlock+1, nil); err != nil {
+					dr.Close()
+					return nil, err
+				}
+			}
+			if j < s.ShingleSize-1 {
+				continue
+			}
+
+			ix.project(window, projections)
+			ix.keys(projections, keys)
+			for table, key := range keys {
+				ix.Keys[table] = append(ix.Keys[table], key)
+				ix.IDs[table] = append(ix.IDs[table], uint32(id+j-(s.ShingleSize-1)))
+			}
+		}
+		if dr.Frames > s.ShingleSize-1 {
+			id += dr.Frames - (s.ShingleSize - 1)
+		}
+		err = dr.Close()
+		if err != nil {
+			return nil, err
+		}
+		t.fileDone()
+		if id > math.MaxUint32 {
+			return nil, fmt.Errorf("more than %d shingles to index", uint32(math.MaxUint32))
+		}
+	}
+
+	for t := range ix.Keys {
+		sort.Sort(&bucketSort{ix.Keys[t], ix.IDs[t]})
+	}
+	return ix, nil
+}
+
+type bucketSort struct {
+	keys []uint64
+	ids  []uint32
+}
+
+func (b *bucketSort) Len() int { return len(b.keys) }
+
+func (b *bucketSort) Less(i, j int) bool {
+	if b.keys[i] != b.keys[j] {
+		return b.keys[i] < b.keys[j]
+	}
+	return b.ids[i] < b.ids[j]
+}
+
+func (b *bucketSort) Swap(i, j int) {
+	b.keys[i], b.keys[j] = b.keys[j], b.keys[i]
+	b.ids[i], b.ids[j] = b.ids[j], b.ids[i]
+}
+
+// LoadShingleIndex reads an index written by Save
+func LoadShingleIndex(fileName string) (*ShingleIndex, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	ix := &ShingleIndex{}
+	err = gob.NewDecoder(f).Decode(ix)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", fileName, err)
+	}
+	ix.makeDirections()
+	return ix, nil
+}
+
+// Save writes the index, the random directions being regenerated from Seed when it is loaded
+func (ix *ShingleIndex) Save(fileName string) error {
+	tmp, err := os.CreateTemp(filepath.Dir(fileName), filepath.Base(fileName)+".*")
+	if err != nil {
+		return err
+	}
+	err = gob.NewEncoder(tmp).Encode(ix)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), fileName)
+}
+
+// Covers reports whether the index was built from exactly these sources with the features of s
+func (ix *ShingleIndex) Covers(sources []FeatureSource, s *SoundSpotter) bool {
+	if len(sources) != len(ix.Sources) || ix.ShingleSize != s.ShingleSize || ix.CqtN != s.CqtN ||
+		len(ix.ChosenFeatures) != len(s.ChosenFeatures) {
+		return false
+	}
+	for i, f := range ix.ChosenFeatures {
+		if s.ChosenFeatures[i] != f {
+			return false
+		}
+	}
+	for i, source := range ix.Sources {
+		if sources[i] != source {
+			return false
+		}
+	}
+	return true
+}
+
+// angular reports whether d ranks shingles by the angle between them, with or without a loudness
+// term, so that shingles close under d agree on the signs the index hashes
+func angular(d Distance) bool {
+	switch d := d.(type) {
+	case MatchedFilter, *MatchedFilter, Cosine, *Cosine:
+		return true
+	case PowerAware:
+		return angular(d.Base)
+	case *PowerAware:
+		return angular(d.Base)
+	}
+	return false
+}
+
+func (ix *ShingleIndex) makeDirections() {
+	r := rand.New(rand.NewSource(ix.Seed))
+	ix.directions = make([][]float64, ix.Tables*ix.Bits)
+	for i := range ix.directions {
+		ix.directions[i] = make([]float64, ix.ShingleSize*len(ix.ChosenFeatures))
+		for j := range ix.directions[i] {
+			ix.directions[i][j] = r.NormFloat64()
+		}
+	}
+}
+
+// project puts the projection of the shingle of frames on each direction in projections
+func (ix *ShingleIndex) project(frames [][]float64, projections []float64) {
+	features := len(ix.ChosenFeatures)
+	for i, direction := range ix.directions {
+		p := 0.0
+		for muxi, frame := range frames {
+			p += dot(frame, direction[muxi*features:(muxi+1)*features])
+		}
+		projections[i] = p
+	}
+}
+
+func (ix *ShingleIndex) keys(projections []float64, keys []uint64) {
+	for t := range keys {
+		key := uint64(0)
+		for b, p := range projections[t*ix.Bits : (t+1)*ix.Bits] {
+			if p >= 0 {
+				key |= 1 << uint(b)
+			}
+		}
+		keys[t] = key
+	}
+}
+
+// bucket returns the ids of the positions with key in table t
+func (ix *ShingleIndex) bucket(t int, key uint64) []uint32 {
+	keys := ix.Keys[t]
+	i := sort.Search(len(keys), func(i int) bool { return keys[i] >= key })
+	j := i
+	for j < len(keys) && keys[j] == key {
+		j++
+	}
+	return ix.IDs[t][i:j]
+}
+
+// candidates returns the sorted ids in the buckets of a query shingle's projections, including the
+// buckets reached by flipping each of its Probes bits nearest the hyperplane in every table
+func (ix *ShingleIndex) candidates(projections []float64) []uint32 {
+	keys := make([]uint64, ix.Tables)
+	ix.keys(projections, keys)
+
+	seen := map[uint32]bool{}
+	for t, key := range keys {
+		probes := []uint64{key}
+		if ix.Probes > 0 {
+			order := make([]int, ix.Bits)
+			for b := range order {
+				order[b] = b
+			}
+			tp := projections[t*ix.Bits : (t+1)*ix.Bits]
+			sort.SliceStable(order, func(i, j int) bool {
+				return math.Abs(tp[order[i]]) < math.Abs(tp[order[j]])
+			})
+			for _, b := range order[:minInt(ix.Probes, ix.Bits)] {
+				probes = append(probes, key^1<<uint(b))
+			}
+		}
+		for _, probe := range probes {
+			for _, id := range ix.bucket(t, probe) {
+				seen[id] = true
+			}
+		}
+	}
+
+	ids := make([]uint32, 0, len(seen))
+	for id := range seen {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+// Match looks up the candidates of each query shingle in the index and re-ranks them with the exact
+// distance of s, keeping s.TopK per shingle as Match does. A shingle whose buckets are all
+// empty gets no candidates.
+func (ix *ShingleIndex) Match(s *SoundSpotter) (*MatchResult, error) {
+	return ix.MatchContext(context.Background(), s, nil)
+}
+
+// MatchContext is Match stopping with the error of ctx once it is cancelled, and reporting its progress
+// over the positions re-ranked to progress if it is not nil
+func (ix *ShingleIndex) MatchContext(ctx context.Context, s *SoundSpotter, progress ProgressFunc) (*MatchResult, error) {
+	if !ix.Covers(ix.Sources, s) {
+		return nil, fmt.Errorf("index built for shingles of %d frames of features %v", ix.ShingleSize, ix.ChosenFeatures)
+	}
+
+	if !angular(s.distance()) {
+		return nil, fmt.Errorf("index hashes the angle between shingles, which %s distance does not rank by",
+			s.distance().Name())
+	}
+	if s.warps() {
+		return nil, fmt.Errorf("index matches rigid shingles, not stretched by %g", s.MaxStretch)
+	}
+	if len(s.transforms()) > 1 {
+		return nil, fmt.Errorf("index matches the database as it is, not transformed")
+	}
+
+	sc, err := newScorer(s)
+	if err != nil {
+		return nil, err
+	}
+
+	x := queryShingles(s)
+	result := NewMatchResult(x, s)
+
+	// the query shingles of each database position, so each is read once
+	byID := map[uint32][]int{}
+	q := queryFrames(s, func(frame []float64) []float64 { return chosenFeatures(frame, s.ChosenFeatures) })
+	projections := make([]float64, ix.Tables*ix.Bits)
+	for ins := 0; ins < x; ins++ {
+		ix.project(q[ins*s.ShingleSize:(ins+1)*s.ShingleSize], projections)
+		for _, id := range ix.candidates(projections) {
+			byID[id] = append(byID[id], ins)
+		}
+	}
+
+	ids := make([]uint32, 0, len(byID))
+	for id := range byID {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	t := newTracker(ctx, progress, len(ids), 0, x)
+	for len(ids) > 0 {
+		si := sort.SearchInts(ix.Offsets, int(ids[0])+1) - 1
+		end := len(ids)
+		if si+1 < len(ix.Offsets) {
+			end = sort.Search(len(ids), func(i int) bool { return int(ids[i]) >= ix.Offsets[si+1] })
+		}
+		err := ix.rerank(t, ix.Sources[si], ix.Offsets[si], ids[:end], byID, q, sc, result)
+		if err != nil {
+			return nil, err
+		}
+		ids = ids[end:]
+	}
+	return result, nil
+}
+
+// rerank computes the exact distance of the query shingles found at each of ids in source
+func (ix *ShingleIndex) rerank(t *tracker, source FeatureSource, offset int, ids []uint32, byID map[uint32][]int,
+	q [][]float64, sc *scorer, result *MatchResult) error {
+
+	err := sc.load(source.DatFileName)
+	if err != nil {
+		return err
+	}
+	dr, err := NewDatReader(source.DatFileName, ix.CqtN)
+	if err != nil {
+		return err
+	}
+	defer dr.Close()
+	if err = dr.checkChosen(ix.ChosenFeatures); err != nil {
+		return err
+	}
+
+	db := make([][]float64, ix.ShingleSize)
+	next := -1
+	for i, id := range ids {
+		if (i+1)%progressBlock == 0 || i == len(ids)-1 {
+			if err = t.advance(i%progressBlock+1, result); err != nil {
+				return err
+			}
+		}
+		position := int(id) - offset
+		if position != next {
+			err = dr.Seek(position)
+			if err != nil {
+				return err
+			}
+			db = db[:0]
+		} else {
+			db = db[1:]
+		}
+		for len(db) < ix.ShingleSize {
+			features, err := dr.Dat()
+			if err != nil {
+				return err
+			}
+			db = append(db, chosenFeatures(features, ix.ChosenFeatures))
+		}
+		next = position + 1
+
+		dbShingle := Shingle{Frames: db, Power: sc.power(position)}
+		result.Pairs += len(byID[id])
+		for _, ins := range byID[id] {
+			dRadius := sc.d.Distance(sc.shingle(q, ins), dbShingle)
+			result.Shingles[ins].Push(Winner{
+				File:    source.Name,
+				MinDist: dRadius,
+				Winner:  position,
+			})
+		}
+	}
+	t.fileDone()
+	return nil
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
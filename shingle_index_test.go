@@ -0,0 +1,67 @@
+package spotifaux_test
+
+import (
+	"github.com/stretchr/testify/assert"
+	"math/rand"
+	"path/filepath"
+	"spotifaux"
+	"testing"
+)
+
+func Test_shingleIndexFindsCorpusShingles(t *testing.T) {
+	r := rand.New(rand.NewSource(4))
+	sources := testCorpus(t, r, 2500, 1500, 2500)
+	s := testSpotter(r, 0)
+
+	dr, err := spotifaux.NewDatReader(sources[1].DatFileName, testCqtN)
+	assert.NoError(t, err)
+	assert.NoError(t, dr.Seek(200))
+	for i := 0; i < 2*s.ShingleSize; i++ {
+		features, err := dr.Dat()
+		assert.NoError(t, err)
+		s.InShingles = append(s.InShingles, features)
+	}
+	assert.NoError(t, dr.Close())
+
+	ix, err := spotifaux.BuildShingleIndex(sources, s, 4, 8, 1)
+	assert.NoError(t, err)
+	ix.Probes = 2
+
+	indexFileName := filepath.Join(t.TempDir(), "corpus.idx")
+	assert.NoError(t, ix.Save(indexFileName))
+	loaded, err := spotifaux.LoadShingleIndex(indexFileName)
+	assert.NoError(t, err)
+	assert.True(t, loaded.Covers(sources, s))
+	loaded.Probes = ix.Probes
+
+	for _, ix := range []*spotifaux.ShingleIndex{ix, loaded} {
+		result, err := ix.Match(s)
+		assert.NoError(t, err)
+		for ins, candidates := range result.Shingles {
+			best := candidates.Best()
+			assert.Equal(t, "b", best.File)
+			assert.Equal(t, 200+ins*s.ShingleSize, best.Winner)
+			assert.InDelta(t, 0, best.MinDist, 1e-9)
+		}
+	}
+
+	// the signs of projections only keep angles
+	s.Distance = spotifaux.Cosine{}
+	_, err = ix.Match(s)
+	assert.NoError(t, err)
+	for _, d := range []spotifaux.Distance{spotifaux.SquaredEuclidean{}, spotifaux.Manhattan{},
+		spotifaux.PowerAware{Base: spotifaux.SquaredEuclidean{}, Weight: 0.1}} {
+
+		s.Distance = d
+		_, err = ix.Match(s)
+		assert.Error(t, err, d.Name())
+		_, err = spotifaux.BuildShingleIndex(sources, s, 4, 8, 1)
+		assert.Error(t, err, d.Name())
+	}
+	s.Distance = nil
+
+	s.ShingleSize = 5
+	assert.False(t, ix.Covers(sources, s))
+	_, err = ix.Match(s)
+	assert.Error(t, err)
+}
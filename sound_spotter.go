@@ -12,30 +12,46 @@ type SoundSpotter struct {
 	ChosenFeatures []int
 	CqtN           int // number of constant-Q coefficients (automatic)
 	InShingles     [][]float64
+	InPowers       []float64           // power of each query frame in dB, needed by PowerAware distances
+	InTransposed   map[int][][]float64 // query frames extracted with Transpose -k, to also match the database k semitones up
+	Reverse        bool                // also match the database played backwards
+	GainOffsets    []float64           // also match the database this many dB louder, for PowerAware distances
 	ShingleSize    int
+	QueryHop       int // frames between the starts of query shingles, ShingleSize if 0
+	TopK           int // candidates kept per shingle by Match, 1 if not set
+	MinSeparation  int // frames between candidates from the same file
+	Backend        MatchBackend
+	PruneFeatures  int      // features in the lower bound used to skip positions, 0 to compare every position in full
+	Distance       Distance // MatchedFilter if not set
+	MaxStretch     float64  // time warp query shingles to windows up to this ratio longer or shorter, 0 or 1 for rigid shingles
+	WarpBand       int      // Sakoe-Chiba band radius of time warping in frames, 0 for no limit beyond MaxStretch
+	MaxDistance    float64  // candidates further than this are dropped by Threshold, 0 for no limit
+	Fallback       Fallback // what FallBack gives shingles without a candidate
+	transform      Transform
 }
 
-func (s *SoundSpotter) Output(fileName string, winner int, inPower float64) ([]float64, error) {
+// Output renders the audio of winner w for the query frames it spans, of power inPower, time stretching
+// a time warped winner to its span and applying the transform it was matched under
+func (s *SoundSpotter) Output(r *AudioReader, w Winner, inPower float64) ([]float64, error) {
 
-	outputLength := Hop * s.ShingleSize
+	outputLength := Hop * w.span(s.ShingleSize)
 	outputBuffer := make([]float64, outputLength) // fix size at constructor ?
-	if winner > -1 {
-
-		sf, err := NewSoundFile(fileName)
-		if err != nil {
-			panic(err)
-		}
-		defer sf.Close()
-
-		_, err = sf.Seek(int64(winner * Hop))
+	if w.Winner > -1 {
+		length := w.length(s.ShingleSize)
+		buf := make([]float64, Hop*length)
+		_, err := r.Read(w.File, w.Winner*Hop, buf)
 		if err != nil {
 			return nil, err
 		}
-
-		buf := make([]float64, outputLength)
-		_, err = sf.ReadFrames(buf)
-		if err != nil {
-			return nil, err
+		if w.Reversed {
+			for i, j := 0, len(buf)-1; i < j; i, j = i+1, j-1 {
+				buf[i], buf[j] = buf[j], buf[i]
+			}
+		}
+		if w.Transpose != 0 {
+			buf = pitchShift(buf, w.Transpose, outputLength)
+		} else if length != w.span(s.ShingleSize) {
+			buf = timeStretch(buf, outputLength)
 		}
 
 		dbPower := 0.0
@@ -48,6 +64,8 @@ func (s *SoundSpotter) Output(fileName string, winner int, inPower float64) ([]f
 		// sqrt(env2) has already been calculated, only take sqrt(env1) here
 		envFollow := 1.0
 		alpha := envFollow*math.Sqrt(inPower/dbPower) + (1.0 - envFollow)
+		// a unit matched louder is rendered as much louder than the query, which the follower alone would undo
+		alpha *= math.Pow(10, w.Gain/20)
 		for p := 0; p < outputLength; p++ {
 			output := alpha * buf[p]
 			if output > 1.12 {
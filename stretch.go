@@ -0,0 +1,107 @@
+package spotifaux
+
+import "math"
+
+// stretchFrame is the length of the segments overlap-added by timeStretch, half of it the output hop
+const stretchFrame = WindowLength
+
+// timeStretch changes the duration of in to n samples without changing its pitch, by waveform
+// similarity overlap-add (WSOLA). Windowed segments are taken from in at the stretched positions and
+// overlap-added at a fixed hop, each shifted by up to half a hop to where it best continues the
+// previous segment, so that the overlaps add in phase.
+func timeStretch(in []float64, n int) []float64 {
+	if len(in) < stretchFrame || n < stretchFrame {
+		// too short for segments, so resample
+		return resample(in, n)
+	}
+
+	out := make([]float64, n)
+	hop := stretchFrame / 2
+	tolerance := hop / 2
+	window := hann(stretchFrame)
+	weight := make([]float64, n)
+
+	last := len(in) - stretchFrame
+	ratio := float64(last) / math.Max(1, float64(n-stretchFrame))
+	prev := -1
+	for k := 0; k*hop < n; k++ {
+		pos := int(math.Round(float64(k*hop) * ratio))
+		if prev >= 0 {
+			pos = bestContinuation(in, prev+hop, pos, tolerance)
+		}
+		if pos > last {
+			pos = last
+		}
+
+		for t := 0; t < stretchFrame && k*hop+t < n; t++ {
+			out[k*hop+t] += window[t] * in[pos+t]
+			weight[k*hop+t] += window[t]
+		}
+		prev = pos
+	}
+
+	for i := range out {
+		out[i] /= weight[i]
+	}
+	return out
+}
+
+// bestContinuation returns the segment position within tolerance of pos whose overlap with the natural
+// continuation of the previous segment, the segment at next, is most correlated
+func bestContinuation(in []float64, next, pos, tolerance int) int {
+	last := len(in) - stretchFrame
+	if next > last {
+		next = last
+	}
+	overlap := stretchFrame / 2
+	best, bestCorr := pos, math.Inf(-1)
+	for d := -tolerance; d <= tolerance; d++ {
+		p := pos + d
+		if p < 0 || p > last {
+			continue
+		}
+		if corr := dot(in[next:next+overlap], in[p:p+overlap]); corr > bestCorr {
+			best, bestCorr = p, corr
+		}
+	}
+	return best
+}
+
+// pitchShift shifts in up by semitones, fitting it into n samples. It is stretched by the pitch ratio
+// without changing its pitch and then resampled back, which raises the pitch by as much.
+func pitchShift(in []float64, semitones, n int) []float64 {
+	ratio := math.Pow(2, float64(semitones)/12)
+	return resample(timeStretch(in, int(math.Round(ratio*float64(n)))), n)
+}
+
+// resample changes the length of in to n samples by linear interpolation, shifting its pitch by len(in)/n
+func resample(in []float64, n int) []float64 {
+	out := make([]float64, n)
+	for i := range out {
+		out[i] = sampleAt(in, float64(i)*float64(len(in))/float64(n))
+	}
+	return out
+}
+
+// hann is a Hann window of n samples taken between the zeros, so it sums to one at half overlap but no
+// sample has zero weight
+func hann(n int) []float64 {
+	window := make([]float64, n)
+	for t := range window {
+		window[t] = 0.5 - 0.5*math.Cos(2*math.Pi*(float64(t)+0.5)/float64(n))
+	}
+	return window
+}
+
+// sampleAt interpolates in linearly at fractional index x
+func sampleAt(in []float64, x float64) float64 {
+	if len(in) == 0 {
+		return 0
+	}
+	i := int(x)
+	if i >= len(in)-1 {
+		return in[len(in)-1]
+	}
+	f := x - float64(i)
+	return in[i]*(1-f) + in[i+1]*f
+}
@@ -0,0 +1,48 @@
+package spotifaux
+
+import "sort"
+
+// Transform is a variant of the database units that is matched and rendered without storing new audio
+type Transform struct {
+	Transpose int     // semitones up, matched by the query frames of SoundSpotter.InTransposed
+	Reversed  bool    // played backwards, matched by the query shingles read backwards
+	Gain      float64 // dB louder, which only PowerAware distances notice
+}
+
+// transforms returns every transform of the database that s matches, the identity first
+func (s *SoundSpotter) transforms() []Transform {
+	reversed := []bool{false}
+	if s.Reverse {
+		reversed = append(reversed, true)
+	}
+	gains := []float64{0}
+	if _, weight, _ := factorDistance(s.distance()); weight != 0 {
+		for _, gain := range s.GainOffsets {
+			if gain != 0 {
+				gains = append(gains, gain)
+			}
+		}
+	}
+
+	var transforms []Transform
+	for _, k := range append([]int{0}, s.transpositions()...) {
+		for _, r := range reversed {
+			for _, gain := range gains {
+				transforms = append(transforms, Transform{Transpose: k, Reversed: r, Gain: gain})
+			}
+		}
+	}
+	return transforms
+}
+
+// transpositions returns the semitones of s.InTransposed other than 0, in order
+func (s *SoundSpotter) transpositions() []int {
+	var ks []int
+	for k := range s.InTransposed {
+		if k != 0 {
+			ks = append(ks, k)
+		}
+	}
+	sort.Ints(ks)
+	return ks
+}
@@ -0,0 +1,84 @@
+package spotifaux_test
+
+import (
+	"github.com/stretchr/testify/assert"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"spotifaux"
+	"testing"
+)
+
+func Test_matchFindsReversedAndLouderShingles(t *testing.T) {
+	r := rand.New(rand.NewSource(13))
+	s := testSpotter(r, 12)
+	s.TopK = 1
+	s.Distance = spotifaux.PowerAware{Base: spotifaux.MatchedFilter{}, Weight: 0.1}
+
+	// the first query shingle backwards at frame 100, and the third 6 dB quieter at frame 300
+	frames := randomFrames(r, 400)
+	powers := make([]float64, len(frames))
+	for i := range powers {
+		powers[i] = -30
+	}
+	backwards := quantizeFrames(s.InShingles[:s.ShingleSize])
+	for j := range backwards {
+		frames[100+j] = backwards[len(backwards)-1-j]
+	}
+	copy(frames[300:], quantizeFrames(s.InShingles[2*s.ShingleSize:3*s.ShingleSize]))
+	for j := 0; j < s.ShingleSize; j++ {
+		powers[300+j] = -36
+	}
+	for range s.InShingles {
+		s.InPowers = append(s.InPowers, -30)
+	}
+	source := testCorpus(t, r, 400)[0]
+	writeTestDat(t, source.DatFileName, frames)
+	assert.NoError(t, spotifaux.WritePowers(spotifaux.PowerFileName(source.DatFileName), powers))
+
+	s.Reverse = true
+	s.GainOffsets = []float64{-6, 6}
+	result, err := spotifaux.Match(source.Name, source.DatFileName, s)
+	assert.NoError(t, err)
+
+	reversed := result.Shingles[0].Best()
+	assert.Equal(t, 100, reversed.Winner)
+	assert.True(t, reversed.Reversed)
+	assert.Equal(t, 0.0, reversed.Gain)
+	assert.InDelta(t, 0, reversed.MinDist, 1e-9)
+
+	louder := result.Shingles[2].Best()
+	assert.Equal(t, 300, louder.Winner)
+	assert.False(t, louder.Reversed)
+	assert.Equal(t, 6.0, louder.Gain)
+	assert.InDelta(t, 0, louder.MinDist, 1e-6)
+}
+
+func Test_outputAppliesGainAfterFollowingTheQuery(t *testing.T) {
+	dir := t.TempDir()
+	tone := make([]float64, 4000)
+	for i := range tone {
+		tone[i] = 0.05 * math.Sin(2*math.Pi*440*float64(i)/spotifaux.SAMPLE_RATE)
+	}
+	writeTestWav(t, filepath.Join(dir, "tone.wav"), tone, spotifaux.SAMPLE_RATE)
+	r := spotifaux.NewAudioReader(os.DirFS(dir))
+
+	s := &spotifaux.SoundSpotter{ShingleSize: 4}
+	inPower := 0.02 // of a sine of amplitude 0.2
+	level := func(gain float64) float64 {
+		out, err := s.Output(r, spotifaux.Winner{File: "tone.wav", Winner: 5, Gain: gain}, inPower)
+		assert.NoError(t, err)
+		assert.Len(t, out, 4*spotifaux.Hop)
+		power := 0.0
+		for _, v := range out {
+			power += v * v
+		}
+		return power / float64(len(out))
+	}
+
+	// followed to the query's level, then scaled by 0.8
+	assert.InDelta(t, 0.64*inPower, level(0), 1e-4)
+	assert.InDelta(t, 0.64*inPower*math.Pow(10, 0.6), level(6), 1e-3)
+	assert.InDelta(t, 0.64*inPower*math.Pow(10, -0.6), level(-6), 1e-4)
+}
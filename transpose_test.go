@@ -0,0 +1,56 @@
+package spotifaux_test
+
+import (
+	"github.com/stretchr/testify/assert"
+	"math"
+	"math/rand"
+	"spotifaux"
+	"testing"
+)
+
+func Test_matchFindsTransposedShingle(t *testing.T) {
+	r := rand.New(rand.NewSource(12))
+	s := testSpotter(r, 12)
+	s.TopK = 1
+
+	// the second shingle of the query transposed down 3 semitones is at frame 200 of the database, so
+	// there the database matches 3 semitones up
+	transposed := testSpotter(r, 12).InShingles
+	frames := randomFrames(r, 400)
+	copy(frames[200:], quantizeFrames(transposed[s.ShingleSize:2*s.ShingleSize]))
+	source := testCorpus(t, r, 400)[0]
+	writeTestDat(t, source.DatFileName, frames)
+
+	result, err := spotifaux.Match(source.Name, source.DatFileName, s)
+	assert.NoError(t, err)
+	assert.NotEqual(t, 200, result.Shingles[1].Best().Winner)
+
+	s.InTransposed = map[int][][]float64{3: transposed}
+	result, err = spotifaux.Match(source.Name, source.DatFileName, s)
+	assert.NoError(t, err)
+	best := result.Shingles[1].Best()
+	assert.Equal(t, 200, best.Winner)
+	assert.Equal(t, 3, best.Transpose)
+	assert.InDelta(t, 0, best.MinDist, 1e-9)
+}
+
+func Test_pitchShiftKeepsLength(t *testing.T) {
+	in := make([]float64, 2200)
+	for i := range in {
+		in[i] = math.Sin(2 * math.Pi * 440 * float64(i) / spotifaux.SAMPLE_RATE)
+	}
+
+	for _, k := range []int{-5, 7} {
+		out := spotifaux.PitchShift(in, k, len(in))
+		assert.Len(t, out, len(in))
+
+		crossings := 0
+		for i := 1; i < len(out); i++ {
+			if (out[i-1] < 0) != (out[i] < 0) {
+				crossings++
+			}
+		}
+		hz := float64(crossings) / 2 / (float64(len(out)) / spotifaux.SAMPLE_RATE)
+		assert.InDelta(t, 440*math.Pow(2, float64(k)/12), hz, 25)
+	}
+}
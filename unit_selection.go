@@ -0,0 +1,221 @@
+package spotifaux
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+// UnitSelector chooses one of the candidates of each query shingle so that the units join smoothly,
+// as in concatenative speech synthesis, rather than taking each shingle's best on its own.
+//
+// The cost of a sequence of units is TargetWeight times the sum of their distances from their query
+// shingles, plus ConcatWeight times the sum of the spectral discontinuities at the joins, minus
+// ContiguityBonus for each join where a unit carries on from the previous one in the same file. The
+// discontinuity at a join is the distance between the frame that would have followed the previous
+// unit in its file and the first frame of the next unit. Select finds the cheapest sequence with
+// the Viterbi algorithm, so it needs s.TopK candidates per shingle to choose from.
+type UnitSelector struct {
+	TargetWeight    float64
+	ConcatWeight    float64
+	ContiguityBonus float64
+}
+
+// unitFrame is a database frame read for the joins of a selection
+type unitFrame struct {
+	file  string
+	frame int
+}
+
+// Select returns the cheapest sequence of candidates from result, which matched the query of s
+// against sources, with the query position of each shingle
+func (u *UnitSelector) Select(result *MatchResult, sources []FeatureSource, s *SoundSpotter) ([]Winner, error) {
+	sc, err := newScorer(s)
+	if err != nil {
+		return nil, err
+	}
+
+	states := make([][]Winner, len(result.Shingles))
+	for i, c := range result.Shingles {
+		states[i] = selectable(c)
+		for k := range states[i] {
+			states[i][k].Query = i * result.QueryHop
+		}
+	}
+	if len(states) == 0 {
+		return nil, nil
+	}
+
+	frames, err := u.joinFrames(states, result.QueryHop, sources, s, sc)
+	if err != nil {
+		return nil, err
+	}
+
+	cost := make([]float64, len(states[0]))
+	for k, w := range states[0] {
+		cost[k] = u.TargetWeight * targetCost(w)
+	}
+	back := make([][]int, len(states))
+	for i := 1; i < len(states); i++ {
+		next := make([]float64, len(states[i]))
+		back[i] = make([]int, len(states[i]))
+		for k, w := range states[i] {
+			best, bestJ := math.Inf(1), 0
+			for j, v := range states[i-1] {
+				if c := cost[j] + u.joinCost(v, w, result.QueryHop, s.ShingleSize, frames, sc); c < best {
+					best, bestJ = c, j
+				}
+			}
+			next[k] = best + u.TargetWeight*targetCost(w)
+			back[i][k] = bestJ
+		}
+		cost = next
+	}
+
+	k := 0
+	for j := range cost {
+		if cost[j] < cost[k] {
+			k = j
+		}
+	}
+	winners := make([]Winner, len(states))
+	for i := len(states) - 1; i >= 0; i-- {
+		winners[i] = states[i][k]
+		if i > 0 {
+			k = back[i][k]
+		}
+	}
+	return winners, nil
+}
+
+// selectable returns the candidates of a shingle with a distance, best first, or its Best if there
+// are none, so that every shingle has a unit
+func selectable(c *Candidates) []Winner {
+	var winners []Winner
+	for _, w := range c.Winners() {
+		if !math.IsNaN(w.MinDist) && !math.IsInf(w.MinDist, 0) {
+			winners = append(winners, w)
+		}
+	}
+	if len(winners) == 0 {
+		winners = []Winner{c.Best()}
+	}
+	return winners
+}
+
+// targetCost is the distance of a unit from its query shingle, 0 for a shingle without candidates,
+// which are the only units without a finite distance
+func targetCost(w Winner) float64 {
+	if math.IsNaN(w.MinDist) || math.IsInf(w.MinDist, 0) {
+		return 0
+	}
+	return w.MinDist
+}
+
+// continuation is the position in a's file of the unit carrying on from a, hop query frames later.
+// A reversed unit carries on towards the start of the file.
+func continuation(a Winner, hop, shingleSize int) int {
+	step := int(math.Round(float64(hop*a.length(shingleSize)) / float64(a.span(shingleSize))))
+	if a.Reversed {
+		return a.Winner - step
+	}
+	return a.Winner + step
+}
+
+// sameTransform is whether b is rendered like a, so that it can carry on from it
+func sameTransform(a, b Winner) bool {
+	return a.Transpose == b.Transpose && a.Reversed == b.Reversed && a.Gain == b.Gain
+}
+
+// joinCost is the cost of following unit a with unit b
+func (u *UnitSelector) joinCost(a, b Winner, hop, shingleSize int, frames map[unitFrame][]float64, sc *scorer) float64 {
+	if a.Winner < 0 || b.Winner < 0 {
+		return 0
+	}
+	next := continuation(a, hop, shingleSize)
+	if a.File == b.File && b.Winner == next && sameTransform(a, b) {
+		return -u.ContiguityBonus
+	}
+	if u.ConcatWeight == 0 {
+		return 0
+	}
+	f, g := frames[unitFrame{a.File, next}], frames[unitFrame{b.File, b.Winner}]
+	return u.ConcatWeight * sc.frameCost(f, g, math.Sqrt(dot(f, f)), math.Sqrt(dot(g, g)))
+}
+
+// joinFrames reads the features of the frames on either side of every possible join, silence for
+// continuations past either end of a file
+func (u *UnitSelector) joinFrames(states [][]Winner, hop int, sources []FeatureSource, s *SoundSpotter,
+	sc *scorer) (map[unitFrame][]float64, error) {
+
+	frames := map[unitFrame][]float64{}
+	if u.ConcatWeight == 0 {
+		return frames, nil
+	}
+
+	byFile := map[string][]int{}
+	for i, shingle := range states {
+		for _, w := range shingle {
+			if w.Winner < 0 {
+				continue
+			}
+			if i > 0 {
+				byFile[w.File] = append(byFile[w.File], w.Winner)
+			}
+			if i < len(states)-1 {
+				byFile[w.File] = append(byFile[w.File], continuation(w, hop, s.ShingleSize))
+			}
+		}
+	}
+
+	datFiles := map[string]string{}
+	for _, source := range sources {
+		datFiles[source.Name] = source.DatFileName
+	}
+	for file, positions := range byFile {
+		datFileName, ok := datFiles[file]
+		if !ok {
+			return nil, fmt.Errorf("no features for unit file %s", file)
+		}
+		dr, err := NewDatReader(datFileName, s.CqtN)
+		if err != nil {
+			return nil, err
+		}
+		if err = dr.checkChosen(s.ChosenFeatures); err != nil {
+			dr.Close()
+			return nil, err
+		}
+
+		sort.Ints(positions)
+		next := -1
+		for _, p := range positions {
+			key := unitFrame{file, p}
+			if _, ok := frames[key]; ok {
+				continue
+			}
+			if p < 0 || p >= dr.Frames {
+				frames[key] = make([]float64, len(s.ChosenFeatures))
+				continue
+			}
+			if p != next {
+				err = dr.Seek(p)
+				if err != nil {
+					dr.Close()
+					return nil, err
+				}
+			}
+			features, err := dr.Dat()
+			if err != nil {
+				dr.Close()
+				return nil, err
+			}
+			frames[key] = sc.features(features)
+			next = p + 1
+		}
+		err = dr.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return frames, nil
+}
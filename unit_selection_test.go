@@ -0,0 +1,37 @@
+package spotifaux_test
+
+import (
+	"github.com/stretchr/testify/assert"
+	"math/rand"
+	"spotifaux"
+	"testing"
+)
+
+func Test_unitSelectionPrefersSmoothJoins(t *testing.T) {
+	r := rand.New(rand.NewSource(8))
+	sources := testCorpus(t, r, 100, 100)
+	s := testSpotter(r, 8)
+
+	// the second shingle's best jumps to b, while a carries on from the first shingle's unit
+	result := spotifaux.NewMatchResult(2, s)
+	result.Shingles[0].Push(spotifaux.Winner{File: "a", Winner: 10, MinDist: 0.1})
+	result.Shingles[1].Push(spotifaux.Winner{File: "b", Winner: 50, MinDist: 0.1})
+	result.Shingles[1].Push(spotifaux.Winner{File: "a", Winner: 14, MinDist: 0.15})
+
+	for _, test := range []struct {
+		selector spotifaux.UnitSelector
+		file     string
+		winner   int
+	}{
+		{spotifaux.UnitSelector{TargetWeight: 1}, "b", 50},
+		{spotifaux.UnitSelector{TargetWeight: 1, ContiguityBonus: 0.1}, "a", 14},
+		{spotifaux.UnitSelector{TargetWeight: 1, ConcatWeight: 1}, "a", 14},
+	} {
+		winners, err := test.selector.Select(result, sources, s)
+		assert.NoError(t, err)
+		assert.Equal(t, []spotifaux.Winner{
+			{Query: 0, File: "a", Winner: 10, MinDist: 0.1},
+			{Query: 4, File: test.file, Winner: test.winner, MinDist: winners[1].MinDist},
+		}, winners)
+	}
+}